@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/verisure/verisure/fake"
+)
+
+func main() {
+	var addr, fixturePath string
+	flag.StringVar(&addr, "a", "localhost:8090", "Listen address")
+	flag.StringVar(&fixturePath, "f", "verisure/fake/testdata/fixture.json", "Fixture file")
+	flag.Parse()
+
+	fixture, err := fake.LoadFixture(fixturePath)
+	if err != nil {
+		log.Fatal("Can't load fixture file. Error: ", err)
+	}
+
+	log.Infof("Fake Verisure API listening on http://%s", addr)
+	log.Fatal(http.ListenAndServe(addr, fake.NewServer(fixture)))
+}
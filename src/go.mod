@@ -2,6 +2,7 @@ module github.com/thingsplex/verisure
 
 require (
 	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/futurehomeno/fimpgo v1.6.2-0.20201211200024-0b1e34f31ef1
 	github.com/sirupsen/logrus v1.3.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
@@ -0,0 +1,84 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// AddressRegistry maps Verisure device labels to the FIMP service addresses of the devices, and back.
+// An address is kept once it is assigned, so a device keeps its address in Futurehome.
+type AddressRegistry struct {
+	mu        sync.Mutex
+	addresses map[string]string
+}
+
+func NewAddressRegistry() *AddressRegistry {
+	return &AddressRegistry{addresses: map[string]string{}}
+}
+
+// GetAddress returns the address of a device, assigning one the first time the label is seen. A new address is
+// the label without spaces, as older versions made it, with a number added if another device already has it.
+func (ar *AddressRegistry) GetAddress(deviceLabel string) string {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+
+	if address, ok := ar.addresses[deviceLabel]; ok {
+		return address
+	}
+
+	base := strings.ReplaceAll(deviceLabel, " ", "")
+	address := base
+	for n := 2; ar.isTaken(address); n++ {
+		address = fmt.Sprintf("%s_%d", base, n)
+	}
+	ar.addresses[deviceLabel] = address
+	return address
+}
+
+// GetDeviceLabel returns the label of the device with the address, or an empty string if the address is unknown.
+func (ar *AddressRegistry) GetDeviceLabel(address string) string {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+
+	for deviceLabel, a := range ar.addresses {
+		if a == address {
+			return deviceLabel
+		}
+	}
+	return ""
+}
+
+func (ar *AddressRegistry) IsEmpty() bool {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	return len(ar.addresses) == 0
+}
+
+func (ar *AddressRegistry) isTaken(address string) bool {
+	for _, a := range ar.addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+func (ar *AddressRegistry) MarshalJSON() ([]byte, error) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	return json.Marshal(ar.addresses)
+}
+
+func (ar *AddressRegistry) UnmarshalJSON(data []byte) error {
+	addresses := map[string]string{}
+	if err := json.Unmarshal(data, &addresses); err != nil {
+		return err
+	}
+
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	ar.addresses = addresses
+	return nil
+}
@@ -1,12 +1,33 @@
 package model
 
+const (
+	AuthStatusCodeRequired = "CODE_REQUIRED"
+
+	// AuthStateExpiring is the app auth state while the Verisure session still works, but expires soon and
+	// has to be renewed with a new login.
+	AuthStateExpiring = "EXPIRING"
+
+	// Error codes sent in AuthStatus when cmd.auth.login is rejected before contacting Verisure.
+	AuthErrorCodeDecryptionFailed   = "DECRYPTION_FAILED"
+	AuthErrorCodeEncryptionRequired = "ENCRYPTION_REQUIRED"
+
+	MFAMethodSMS   = "sms"
+	MFAMethodEmail = "email"
+)
+
 type Login struct {
 	Username  string `json:"username"`
 	Password  string `json:"password"`
 	Encrypted bool   `json:"encrypted"`
+	MFAMethod string `json:"mfa_method"`
+}
+
+type MFACode struct {
+	Code string `json:"code"`
 }
 
 type SetTokens struct {
+	Username     string `json:"username"`
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 	Encrypted    bool   `json:"encrypted"`
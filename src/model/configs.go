@@ -2,10 +2,13 @@ package model
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/futurehomeno/fimpgo/edgeapp"
@@ -15,25 +18,42 @@ import (
 
 const ServiceName = "verisure"
 
+// Pin policies decide where the pin for locking and unlocking smart locks may come from.
+const (
+	PinPolicyStored   = "stored"
+	PinPolicyOnDemand = "on_demand"
+	PinPolicyBoth     = "both"
+)
+
 type Configs struct {
-	path               string
-	InstanceAddress    string    `json:"instance_address"`
-	MqttServerURI      string    `json:"mqtt_server_uri"`
-	MqttUsername       string    `json:"mqtt_server_username"`
-	MqttPassword       string    `json:"mqtt_server_password"`
-	MqttClientIdPrefix string    `json:"mqtt_client_id_prefix"`
-	LogFile            string    `json:"log_file"`
-	LogLevel           string    `json:"log_level"`
-	LogFormat          string    `json:"log_format"`
-	WorkDir            string    `json:"-"`
-	ConfiguredAt       string    `json:"configured_at"`
-	ConfiguredBy       string    `json:"configured_by"`
-	AccessToken        string    `json:"access_token"`
-	AccessExpires      time.Time `json:"access_token_expires"`
-	RefreshToken       string    `json:"refresh_token"`
-	RefreshExpires     time.Time `json:"refresh_token_expires"`
-	LockPin            int64     `json:"lock_pin"`
-	Installation       string    `json:"installation"`
+	path                  string
+	secrets               *SecretStore
+	legacyPins            map[string]bool
+	InstanceAddress       string             `json:"instance_address"`
+	MqttServerURI         string             `json:"mqtt_server_uri"`
+	MqttUsername          string             `json:"mqtt_server_username"`
+	MqttPassword          string             `json:"mqtt_server_password"`
+	MqttClientIdPrefix    string             `json:"mqtt_client_id_prefix"`
+	LogFile               string             `json:"log_file"`
+	LogLevel              string             `json:"log_level"`
+	LogFormat             string             `json:"log_format"`
+	WorkDir               string             `json:"-"`
+	ConfiguredAt          string             `json:"configured_at"`
+	ConfiguredBy          string             `json:"configured_by"`
+	AccessToken           string             `json:"access_token"`
+	AccessExpires         time.Time          `json:"access_token_expires"`
+	RefreshToken          string             `json:"refresh_token"`
+	RefreshExpires        time.Time          `json:"refresh_token_expires"`
+	LockPin               PinCode            `json:"lock_pin"`
+	LockPins              map[string]PinCode `json:"lock_pins,omitempty"`
+	AlarmPin              PinCode            `json:"alarm_pin"`
+	PinPolicy             string             `json:"pin_policy"`
+	PinPolicies           map[string]string  `json:"pin_policies"`
+	AllowHazardousPlugs   bool               `json:"allow_hazardous_plugs"`
+	RequireEncryptedLogin bool               `json:"require_encrypted_login"`
+	RememberLogin         bool               `json:"remember_login"`
+	AutoInclusion         bool               `json:"auto_inclusion"`
+	Installation          string             `json:"installation"`
 }
 
 func NewConfigs(workDir string) *Configs {
@@ -60,21 +80,104 @@ func (cf *Configs) LoadFromFile() error {
 	if err != nil {
 		return err
 	}
+	cf.legacyPins = findLegacyPins(configFileBody)
+	if cf.secrets != nil && cf.decryptSecrets() {
+		log.Info("Encrypting secrets in config file")
+		return cf.SaveToFile()
+	}
 	return nil
 }
 
 func (cf *Configs) SaveToFile() error {
 	cf.ConfiguredBy = "auto"
 	cf.ConfiguredAt = time.Now().Format(time.RFC3339)
-	bpayload, err := json.Marshal(cf)
+	saved := *cf
+	if cf.secrets != nil {
+		if err := saved.encryptSecrets(); err != nil {
+			return err
+		}
+	}
+	bpayload, err := json.Marshal(saved)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(cf.path, bpayload, 0664)
+	err = ioutil.WriteFile(cf.path, bpayload, 0600)
 	if err != nil {
 		return err
 	}
-	return err
+	return os.Chmod(cf.path, 0600)
+}
+
+// UseSecretStore makes the configs encrypt tokens and pins in the config file.
+func (cf *Configs) UseSecretStore(secrets *SecretStore) {
+	cf.secrets = secrets
+}
+
+// Redacted returns a copy of the configs without tokens, passwords and pins, to be sent over MQTT.
+func (cf *Configs) Redacted() *Configs {
+	redacted := *cf
+	redacted.MqttPassword = ""
+	redacted.AccessToken = ""
+	redacted.RefreshToken = ""
+	redacted.LockPin = ""
+	redacted.LockPins = nil
+	redacted.AlarmPin = ""
+	return &redacted
+}
+
+// secretFields returns the fields that are encrypted in the config file, except the pins of single locks.
+func (cf *Configs) secretFields() []*string {
+	return []*string{&cf.AccessToken, &cf.RefreshToken, (*string)(&cf.LockPin), (*string)(&cf.AlarmPin)}
+}
+
+// encryptSecrets encrypts the secrets of a copy of the configs that is about to be saved.
+func (cf *Configs) encryptSecrets() error {
+	for _, field := range cf.secretFields() {
+		encrypted, err := cf.secrets.Encrypt(*field)
+		if err != nil {
+			return err
+		}
+		*field = encrypted
+	}
+	lockPins := map[string]PinCode{}
+	for deviceLabel, pin := range cf.LockPins {
+		encrypted, err := cf.secrets.Encrypt(string(pin))
+		if err != nil {
+			return err
+		}
+		lockPins[deviceLabel] = PinCode(encrypted)
+	}
+	cf.LockPins = lockPins
+	return nil
+}
+
+// decryptSecrets decrypts the secrets read from the config file and returns true if any of them was stored as plain text.
+// A secret that can't be decrypted, e.g. because the key file was replaced, is dropped.
+func (cf *Configs) decryptSecrets() bool {
+	plain := false
+	decrypt := func(value string) string {
+		if value == "" {
+			return ""
+		}
+		if !IsEncrypted(value) {
+			plain = true
+			return value
+		}
+		decrypted, err := cf.secrets.Decrypt(value)
+		if err != nil {
+			log.Error("Can't decrypt secret in config file: ", err)
+			return ""
+		}
+		return decrypted
+	}
+
+	for _, field := range cf.secretFields() {
+		*field = decrypt(*field)
+	}
+	for deviceLabel, pin := range cf.LockPins {
+		cf.LockPins[deviceLabel] = PinCode(decrypt(string(pin)))
+	}
+	return plain
 }
 
 func (cf *Configs) GetDataDir() string {
@@ -93,6 +196,129 @@ func (cf *Configs) LoadDefaults() error {
 	return utils.CopyFile(defaultConfigFile, configFile)
 }
 
+// PinCode is a pin kept as a string so that leading zeros survive. It also reads the number
+// that older versions stored in lock_pin; MigrateLockPins restores the zeros that number lost.
+type PinCode string
+
+// findLegacyPins returns the pins that the config file holds as numbers, by device label, with an empty label for
+// lock_pin.
+func findLegacyPins(configFileBody []byte) map[string]bool {
+	raw := struct {
+		LockPin  json.RawMessage            `json:"lock_pin"`
+		LockPins map[string]json.RawMessage `json:"lock_pins"`
+	}{}
+	legacyPins := map[string]bool{}
+	if err := json.Unmarshal(configFileBody, &raw); err != nil {
+		return legacyPins
+	}
+	isNumber := func(value json.RawMessage) bool {
+		return len(value) > 0 && value[0] >= '0' && value[0] <= '9'
+	}
+	if isNumber(raw.LockPin) {
+		legacyPins[""] = true
+	}
+	for deviceLabel, pin := range raw.LockPins {
+		if isNumber(pin) {
+			legacyPins[deviceLabel] = true
+		}
+	}
+	return legacyPins
+}
+
+func (pc *PinCode) UnmarshalJSON(data []byte) error {
+	var pin string
+	if err := json.Unmarshal(data, &pin); err == nil {
+		*pc = PinCode(pin)
+		return nil
+	}
+	var legacy int64
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	*pc = ""
+	if legacy != 0 {
+		*pc = PinCode(strconv.FormatInt(legacy, 10))
+	}
+	return nil
+}
+
+// ValidatePin checks that a pin only has digits and, if the length is known, is as long as the installation requires.
+func ValidatePin(pin string, length int) error {
+	if pin == "" {
+		return errors.New("pin is empty")
+	}
+	if length > 0 && len(pin) != length {
+		return fmt.Errorf("pin must be %d digits", length)
+	}
+	for _, r := range pin {
+		if r < '0' || r > '9' {
+			return errors.New("pin must only contain digits")
+		}
+	}
+	return nil
+}
+
+// GetLockPin returns the pin stored for a smart lock, falling back to the pin shared by all locks.
+func (cf *Configs) GetLockPin(deviceLabel string) string {
+	if pin, ok := cf.LockPins[deviceLabel]; ok && pin != "" {
+		return string(pin)
+	}
+	return string(cf.LockPin)
+}
+
+func (cf *Configs) SetLockPin(deviceLabel string, pin string) {
+	if cf.LockPins == nil {
+		cf.LockPins = map[string]PinCode{}
+	}
+	if pin == "" {
+		delete(cf.LockPins, deviceLabel)
+		return
+	}
+	cf.LockPins[deviceLabel] = PinCode(pin)
+}
+
+// MigrateLockPins pads pins that were read as numbers and are shorter than the installation pin length with the
+// leading zeros that were lost when lock_pin was stored as a number. Pins stored as strings are left as they are.
+// It returns true if any pin was changed.
+func (cf *Configs) MigrateLockPins(length int) bool {
+	pad := func(deviceLabel string, pin PinCode) PinCode {
+		if !cf.legacyPins[deviceLabel] || pin == "" || len(pin) >= length {
+			return pin
+		}
+		return PinCode(strings.Repeat("0", length-len(pin))) + pin
+	}
+
+	changed := false
+	if padded := pad("", cf.LockPin); padded != cf.LockPin {
+		cf.LockPin = padded
+		changed = true
+	}
+	for deviceLabel, pin := range cf.LockPins {
+		if padded := pad(deviceLabel, pin); padded != pin {
+			cf.LockPins[deviceLabel] = padded
+			changed = true
+		}
+	}
+	cf.legacyPins = nil
+	return changed
+}
+
+// GetPinPolicy returns the pin policy for an installation, defaulting to the stored pin.
+func (cf *Configs) GetPinPolicy(giid string) string {
+	if policy, ok := cf.PinPolicies[giid]; ok {
+		return policy
+	}
+	return PinPolicyStored
+}
+
+func (cf *Configs) SetPinPolicy(giid string, policy string) {
+	if cf.PinPolicies == nil {
+		cf.PinPolicies = map[string]string{}
+	}
+	cf.PinPolicies[giid] = policy
+	cf.PinPolicy = policy
+}
+
 func (cf *Configs) IsAuthenticated() bool {
 	if cf.AccessToken != "" && cf.AccessToken != "access_token" {
 		return true
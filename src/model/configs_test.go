@@ -0,0 +1,68 @@
+package model
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateLockPins(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		wantLoaded  PinCode
+		wantPin     PinCode
+		wantChanged bool
+	}{
+		{"legacy number that lost its leading zero", `{"lock_pin": 123}`, "123", "0123", true},
+		{"legacy number of the right length", `{"lock_pin": 1234}`, "1234", "1234", false},
+		{"string pin that is too short", `{"lock_pin": "123"}`, "123", "123", false},
+		{"string pin with a leading zero", `{"lock_pin": "0123"}`, "0123", "0123", false},
+		{"no pin", `{"lock_pin": 0}`, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := newTestWorkDir(t)
+			if err := ioutil.WriteFile(filepath.Join(workDir, "data", "config.json"), []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			configs := NewConfigs(workDir)
+			if err := configs.LoadFromFile(); err != nil {
+				t.Fatal(err)
+			}
+			if configs.LockPin != tt.wantLoaded {
+				t.Errorf("loaded pin %q, want %q", configs.LockPin, tt.wantLoaded)
+			}
+
+			if changed := configs.MigrateLockPins(4); changed != tt.wantChanged {
+				t.Errorf("changed: %t, want %t", changed, tt.wantChanged)
+			}
+			if configs.LockPin != tt.wantPin {
+				t.Errorf("migrated pin %q, want %q", configs.LockPin, tt.wantPin)
+			}
+		})
+	}
+}
+
+func TestMigrateLockPinsOfSingleLocks(t *testing.T) {
+	workDir := newTestWorkDir(t)
+	config := `{"lock_pin": "0001", "lock_pins": {"CDEF GHIJ": 12, "DEFG HIJK": "12"}}`
+	if err := ioutil.WriteFile(filepath.Join(workDir, "data", "config.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configs := NewConfigs(workDir)
+	if err := configs.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	configs.MigrateLockPins(4)
+	if pin := configs.GetLockPin("CDEF GHIJ"); pin != "0012" {
+		t.Errorf("legacy pin of a lock migrated to %q, want 0012", pin)
+	}
+	if pin := configs.GetLockPin("DEFG HIJK"); pin != "12" {
+		t.Errorf("string pin of a lock migrated to %q, want 12", pin)
+	}
+	if err := ValidatePin(configs.GetLockPin("DEFG HIJK"), 4); err == nil {
+		t.Error("a pin that is too short is valid")
+	}
+}
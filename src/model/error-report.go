@@ -0,0 +1,17 @@
+package model
+
+// Error codes sent in the code property of evt.error.report when a command fails.
+const (
+	ErrorCodeInvalidRequest       = "INVALID_REQUEST"
+	ErrorCodeUnknownDevice        = "UNKNOWN_DEVICE"
+	ErrorCodeNotAllowed           = "NOT_ALLOWED"
+	ErrorCodeInvalidPin           = "INVALID_PIN"
+	ErrorCodeWrongPin             = "WRONG_PIN"
+	ErrorCodeLockBusy             = "LOCK_BUSY"
+	ErrorCodeLockJammed           = "LOCK_JAMMED"
+	ErrorCodeTimeout              = "TIMEOUT"
+	ErrorCodeSessionExpired       = "SESSION_EXPIRED"
+	ErrorCodeRateLimited          = "RATE_LIMITED"
+	ErrorCodeInstallationNotFound = "INSTALLATION_NOT_FOUND"
+	ErrorCodeCommandFailed        = "COMMAND_FAILED"
+)
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"github.com/futurehomeno/fimpgo/utils"
+)
+
+// LoginKey is the P-256 key pair of the app, used to decrypt credentials sent encrypted in cmd.auth.login.
+//
+// An encrypted value is base64 of the sender's ephemeral public key (65 bytes, uncompressed), a 12 byte nonce and
+// the AES-256-GCM ciphertext, with the SHA-256 of the ECDH shared secret as the AES key.
+type LoginKey struct {
+	private *ecdsa.PrivateKey
+}
+
+// NewLoginKey loads the key pair from a PEM file, creating it with a new key if it does not exist.
+func NewLoginKey(keyPath string) (*LoginKey, error) {
+	if !utils.FileExists(keyPath) {
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0400); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Chmod(keyPath, 0400); err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, errors.New("login key file is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("login key is not an EC key")
+	}
+	if private.Curve != elliptic.P256() {
+		return nil, errors.New("login key is not a P-256 key")
+	}
+	return &LoginKey{private: private}, nil
+}
+
+// PublicKeyPEM returns the public key that clients encrypt credentials with, PEM encoded.
+func (lk *LoginKey) PublicKeyPEM() string {
+	der, err := x509.MarshalPKIXPublicKey(&lk.private.PublicKey)
+	if err != nil {
+		return ""
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func (lk *LoginKey) Decrypt(value string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	const publicKeySize = 65
+	if len(data) < publicKeySize {
+		return "", errors.New("encrypted value is too short")
+	}
+
+	// The shared secret is the X coordinate of the product of the private key and the ephemeral public key.
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, data[:publicKeySize])
+	if x == nil {
+		return "", errors.New("invalid ephemeral public key")
+	}
+	sharedX, _ := curve.ScalarMult(x, y, lk.private.D.Bytes())
+	shared := make([]byte, (curve.Params().BitSize+7)/8)
+	sharedX.FillBytes(shared)
+	key := sha256.Sum256(shared)
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	sealed := data[publicKeySize:]
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,118 @@
+package model
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+)
+
+// seal encrypts plain for the public key the way a client of cmd.auth.login does, and returns the raw encrypted value.
+func seal(t *testing.T, publicKeyPEM string, plain string) []byte {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		t.Fatal("public key is not PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := key.(*ecdsa.PublicKey)
+
+	ephemeral, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedX, _ := public.Curve.ScalarMult(public.X, public.Y, ephemeral.D.Bytes())
+	shared := make([]byte, 32)
+	sharedX.FillBytes(shared)
+	aesKey := sha256.Sum256(shared)
+
+	cipherBlock, err := aes.NewCipher(aesKey[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(cipherBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+
+	data := elliptic.Marshal(elliptic.P256(), ephemeral.X, ephemeral.Y)
+	data = append(data, nonce...)
+	return aead.Seal(data, nonce, []byte(plain), nil)
+}
+
+func newTestLoginKey(t *testing.T) *LoginKey {
+	loginKey, err := NewLoginKey(filepath.Join(t.TempDir(), "login-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loginKey
+}
+
+func TestLoginKeyDecrypt(t *testing.T) {
+	loginKey := newTestLoginKey(t)
+	sealed := seal(t, loginKey.PublicKeyPEM(), testSecret)
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	badPoint := append([]byte{}, sealed...)
+	badPoint[1] ^= 1
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"round trip", base64.StdEncoding.EncodeToString(sealed), testSecret, false},
+		{"tampered ciphertext", base64.StdEncoding.EncodeToString(tampered), "", true},
+		{"public key not on the curve", base64.StdEncoding.EncodeToString(badPoint), "", true},
+		{"shorter than a public key", base64.StdEncoding.EncodeToString(sealed[:64]), "", true},
+		{"no room for the nonce", base64.StdEncoding.EncodeToString(sealed[:70]), "", true},
+		{"not base64", "not base64!", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loginKey.Decrypt(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginKeyIsKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "login-key.pem")
+	first, err := NewLoginKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewLoginKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.PublicKeyPEM() != second.PublicKeyPEM() {
+		t.Error("a new login key was created instead of loading the saved one")
+	}
+
+	// A value encrypted for the first key can be decrypted after a restart.
+	sealed := base64.StdEncoding.EncodeToString(seal(t, first.PublicKeyPEM(), testSecret))
+	if got, err := second.Decrypt(sealed); err != nil || got != testSecret {
+		t.Errorf("got %q, %v after loading the key again", got, err)
+	}
+}
@@ -2,12 +2,75 @@ package model
 
 import (
 	"fmt"
-	"strings"
+	"time"
 
 	"github.com/futurehomeno/fimpgo/fimptype"
 )
 
+// NetworkService builds the inclusion reports of the devices, with the addresses from Addresses.
 type NetworkService struct {
+	Addresses *AddressRegistry
+}
+
+// NetworkNode is a device in evt.network.all_nodes_report.
+type NetworkNode struct {
+	Address     string     `json:"address"`
+	Services    []string   `json:"services"`
+	DeviceLabel string     `json:"device_label"`
+	Area        string     `json:"area"`
+	GuiType     string     `json:"gui_type"`
+	PowerSource string     `json:"power_source"`
+	LastReport  *time.Time `json:"last_report,omitempty"`
+}
+
+// GetAllNodes lists the devices cached in the states, and the alarm panel of the installation unless it is ignored.
+// Addresses and power sources are taken from the inclusion reports, so they match what was included.
+func (ns *NetworkService) GetAllNodes(states *States, giid string) []NetworkNode {
+	nodes := []NetworkNode{}
+	for _, climate := range states.Climates {
+		nodes = append(nodes, newNetworkNode(ns.SendClimateInclusionReport(climate), climate.Device, climate.TemperatureTimestamp))
+	}
+	for _, doorWindow := range states.DoorWindows {
+		nodes = append(nodes, newNetworkNode(ns.SendDoorWindowInclusionReport(doorWindow), doorWindow.Device, doorWindow.ReportTime))
+	}
+	for _, smartLock := range states.SmartLocks {
+		nodes = append(nodes, newNetworkNode(ns.SendSmartLockInclusionReport(smartLock), smartLock.Device, smartLock.EventTime))
+	}
+	for _, smartPlug := range states.SmartPlugs {
+		nodes = append(nodes, newNetworkNode(ns.SendSmartPlugInclusionReport(smartPlug), smartPlug.Device, time.Time{}))
+	}
+
+	if giid != "" && !states.IsIgnored(giid) {
+		installation := states.GetInstallationByGIID(giid)
+		if installation == nil {
+			installation = &Installation{Giid: giid}
+		}
+		lastReport := time.Time{}
+		if states.ArmState != nil {
+			lastReport = states.ArmState.Date
+		}
+		device := Device{DeviceLabel: giid, Area: installation.Alias, Gui: Gui{Label: "ALARM"}}
+		nodes = append(nodes, newNetworkNode(ns.SendAlarmInclusionReport(*installation), device, lastReport))
+	}
+	return nodes
+}
+
+func newNetworkNode(inclReport fimptype.ThingInclusionReport, device Device, lastReport time.Time) NetworkNode {
+	node := NetworkNode{
+		Address:     inclReport.Address,
+		Services:    []string{},
+		DeviceLabel: device.DeviceLabel,
+		Area:        device.Area,
+		GuiType:     device.Gui.Label,
+		PowerSource: inclReport.PowerSource,
+	}
+	for _, service := range inclReport.Services {
+		node.Services = append(node.Services, service.Address)
+	}
+	if !lastReport.IsZero() {
+		node.LastReport = &lastReport
+	}
+	return node
 }
 
 func (ns *NetworkService) SendClimateInclusionReport(device ClimateDevice) fimptype.ThingInclusionReport {
@@ -26,6 +89,11 @@ func (ns *NetworkService) SendClimateInclusionReport(device ClimateDevice) fimpt
 		MsgType:   "evt.sensor.report",
 		ValueType: "float",
 		Version:   "1",
+	}, {
+		Type:      "out",
+		MsgType:   "evt.error.report",
+		ValueType: "string",
+		Version:   "1",
 	}}
 
 	tempSensorService := fimptype.Service{
@@ -56,7 +124,7 @@ func (ns *NetworkService) SendClimateInclusionReport(device ClimateDevice) fimpt
 		Interfaces:       sensorInterfaces,
 	}
 
-	deviceId := strings.ReplaceAll(device.Device.DeviceLabel, " ", "")
+	deviceId := ns.Addresses.GetAddress(device.Device.DeviceLabel)
 	manufacturer = "verisure"
 	name = fmt.Sprintf("%s %s", device.Device.Gui.Label, device.Device.Area)
 	serviceAddress := deviceId
@@ -121,6 +189,30 @@ func (ns *NetworkService) SendSmartLockInclusionReport(device SmartLockDevice) f
 			ValueType: "bool_map",
 			Version:   "1",
 		},
+		{
+			Type:      "in",
+			MsgType:   "cmd.config.get_report",
+			ValueType: "null",
+			Version:   "1",
+		},
+		{
+			Type:      "in",
+			MsgType:   "cmd.config.set",
+			ValueType: "str_map",
+			Version:   "1",
+		},
+		{
+			Type:      "out",
+			MsgType:   "evt.config.report",
+			ValueType: "str_map",
+			Version:   "1",
+		},
+		{
+			Type:      "out",
+			MsgType:   "evt.error.report",
+			ValueType: "string",
+			Version:   "1",
+		},
 	}
 
 	doorLockService := fimptype.Service{
@@ -130,14 +222,19 @@ func (ns *NetworkService) SendSmartLockInclusionReport(device SmartLockDevice) f
 		Enabled: true,
 		Groups:  []string{"ch_0"},
 		Props: map[string]interface{}{
-			"sup_components": []string{"is_secured"},
+			"sup_components": []string{"is_secured", "door_is_closed"},
+			"sup_config_params": map[string]interface{}{
+				"auto_lock":   []string{"true", "false"},
+				"volume":      toLower(LockVolumes),
+				"voice_level": toLower(LockVoiceLevels),
+			},
 		},
 		Tags:             nil,
 		PropSetReference: "",
 		Interfaces:       sensorInterfaces,
 	}
 
-	deviceId := strings.ReplaceAll(device.Device.DeviceLabel, " ", "")
+	deviceId := ns.Addresses.GetAddress(device.Device.DeviceLabel)
 	manufacturer = "verisure"
 	name = fmt.Sprintf("%s %s", device.Device.Gui.Label, device.Device.Area)
 	serviceAddress := deviceId
@@ -188,6 +285,11 @@ func (ns *NetworkService) SendDoorWindowInclusionReport(device DoorWindowDevice)
 		MsgType:   "evt.open.report",
 		ValueType: "bool",
 		Version:   "1",
+	}, {
+		Type:      "out",
+		MsgType:   "evt.error.report",
+		ValueType: "string",
+		Version:   "1",
 	}}
 
 	tempSensorService := fimptype.Service{
@@ -201,7 +303,7 @@ func (ns *NetworkService) SendDoorWindowInclusionReport(device DoorWindowDevice)
 		Interfaces:       sensorInterfaces,
 	}
 
-	deviceId := strings.ReplaceAll(device.Device.DeviceLabel, " ", "")
+	deviceId := ns.Addresses.GetAddress(device.Device.DeviceLabel)
 	manufacturer = "verisure"
 	name = fmt.Sprintf("%s %s", device.Device.Gui.Label, device.Device.Area)
 	serviceAddress := deviceId
@@ -235,3 +337,170 @@ func (ns *NetworkService) SendDoorWindowInclusionReport(device DoorWindowDevice)
 
 	return inclReport
 }
+
+func (ns *NetworkService) SendAlarmInclusionReport(installation Installation) fimptype.ThingInclusionReport {
+
+	var name, manufacturer string
+	var deviceAddr string
+	services := []fimptype.Service{}
+
+	alarmInterfaces := []fimptype.Interface{
+		{
+			Type:      "in",
+			MsgType:   "cmd.arm.get_report",
+			ValueType: "null",
+			Version:   "1",
+		},
+		{
+			Type:      "in",
+			MsgType:   "cmd.arm.set",
+			ValueType: "string",
+			Version:   "1",
+		},
+		{
+			Type:      "out",
+			MsgType:   "evt.arm.report",
+			ValueType: "string",
+			Version:   "1",
+		},
+		{
+			Type:      "out",
+			MsgType:   "evt.error.report",
+			ValueType: "string",
+			Version:   "1",
+		},
+	}
+
+	alarmService := fimptype.Service{
+		Name:    "alarm_panel",
+		Alias:   "Alarm panel",
+		Address: fmt.Sprintf("/rt:dev/rn:%s/ad:1/sv:alarm_panel/ad:", ServiceName),
+		Enabled: true,
+		Groups:  []string{"ch_0"},
+		Props: map[string]interface{}{
+			"sup_modes": []string{FimpArmStates[ArmStateArmedAway], FimpArmStates[ArmStateArmedHome], FimpArmStates[ArmStateDisarmed]},
+		},
+		Tags:             nil,
+		PropSetReference: "",
+		Interfaces:       alarmInterfaces,
+	}
+
+	deviceId := installation.Giid
+	manufacturer = "verisure"
+	name = "Alarm"
+	if installation.Alias != "" {
+		name = fmt.Sprintf("Alarm %s", installation.Alias)
+	}
+	serviceAddress := deviceId
+	alarmService.Address = alarmService.Address + serviceAddress
+	services = append(services, alarmService)
+
+	deviceAddr = deviceId
+	powerSource := "ac"
+
+	inclReport := fimptype.ThingInclusionReport{
+		IntegrationId:     "",
+		Address:           deviceAddr,
+		Type:              "",
+		ProductHash:       fmt.Sprintf("%s alarm", installation.Giid),
+		Alias:             fmt.Sprintf("%s alarm", manufacturer),
+		CommTechnology:    "",
+		ProductName:       name,
+		ManufacturerId:    manufacturer,
+		DeviceId:          deviceId,
+		HwVersion:         "1",
+		SwVersion:         "1",
+		PowerSource:       powerSource,
+		WakeUpInterval:    "-1",
+		Security:          "",
+		Tags:              nil,
+		Groups:            []string{"ch_0"},
+		PropSets:          nil,
+		TechSpecificProps: nil,
+		Services:          services,
+	}
+
+	return inclReport
+}
+
+func (ns *NetworkService) SendSmartPlugInclusionReport(device SmartPlugDevice) fimptype.ThingInclusionReport {
+
+	var name, manufacturer string
+	var deviceAddr string
+	services := []fimptype.Service{}
+
+	switchInterfaces := []fimptype.Interface{
+		{
+			Type:      "in",
+			MsgType:   "cmd.binary.get_report",
+			ValueType: "null",
+			Version:   "1",
+		},
+		{
+			Type:      "in",
+			MsgType:   "cmd.binary.set",
+			ValueType: "bool",
+			Version:   "1",
+		},
+		{
+			Type:      "out",
+			MsgType:   "evt.binary.report",
+			ValueType: "bool",
+			Version:   "1",
+		},
+		{
+			Type:      "out",
+			MsgType:   "evt.error.report",
+			ValueType: "string",
+			Version:   "1",
+		},
+	}
+
+	switchService := fimptype.Service{
+		Name:    "out_bin_switch",
+		Alias:   "Smart plug",
+		Address: fmt.Sprintf("/rt:dev/rn:%s/ad:1/sv:out_bin_switch/ad:", ServiceName),
+		Enabled: true,
+		Groups:  []string{"ch_0"},
+		Props: map[string]interface{}{
+			"is_hazardous": device.IsHazardous,
+		},
+		Tags:             nil,
+		PropSetReference: "",
+		Interfaces:       switchInterfaces,
+	}
+
+	deviceId := ns.Addresses.GetAddress(device.Device.DeviceLabel)
+	manufacturer = "verisure"
+	name = fmt.Sprintf("%s %s", device.Device.Gui.Label, device.Device.Area)
+	serviceAddress := deviceId
+	switchService.Address = switchService.Address + serviceAddress
+	services = append(services, switchService)
+
+	deviceAddr = deviceId
+	powerSource := "ac"
+
+	inclReport := fimptype.ThingInclusionReport{
+		IntegrationId:     "",
+		Address:           deviceAddr,
+		Type:              "",
+		ProductHash:       fmt.Sprintf("%s %s", device.Device.DeviceLabel, device.Device.Gui.Label),
+		Alias:             fmt.Sprintf("%s %s", manufacturer, device.Device.Gui.Label),
+		CommTechnology:    "",
+		ProductName:       name,
+		ManufacturerId:    manufacturer,
+		DeviceId:          deviceId,
+		HwVersion:         "1",
+		SwVersion:         "1",
+		PowerSource:       powerSource,
+		WakeUpInterval:    "-1",
+		Security:          "",
+		Tags:              nil,
+		Groups:            []string{"ch_0"},
+		PropSets:          nil,
+		TechSpecificProps: nil,
+		Services:          services,
+	}
+
+	return inclReport
+}
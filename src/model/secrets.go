@@ -0,0 +1,104 @@
+package model
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/futurehomeno/fimpgo/utils"
+)
+
+// secretPrefix marks a value encrypted by a SecretStore. Values without it are plain text from older files.
+const secretPrefix = "enc:v1:"
+
+// SecretStore encrypts credentials, cookies and pins before they are written to disk, with a key derived
+// from a key file that only the app can read.
+type SecretStore struct {
+	aead cipher.AEAD
+}
+
+// NewSecretStore loads the key file, creating it with a new random key if it does not exist.
+func NewSecretStore(keyPath string) (*SecretStore, error) {
+	if !utils.FileExists(keyPath) {
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(keyPath, key, 0400); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Chmod(keyPath, 0400); err != nil {
+		return nil, err
+	}
+
+	keyMaterial, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyMaterial) < 32 {
+		return nil, errors.New("secret key file is too short")
+	}
+
+	mac := hmac.New(sha256.New, keyMaterial)
+	mac.Write([]byte("verisure secret store v1"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretStore{aead: aead}, nil
+}
+
+func (ss *SecretStore) Seal(plain []byte) ([]byte, error) {
+	nonce := make([]byte, ss.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := ss.aead.Seal(nonce, nonce, plain, nil)
+	return []byte(secretPrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// Open decrypts a value from Seal. Data that is not encrypted is returned as it is, so older files can be read.
+func (ss *SecretStore) Open(data []byte) ([]byte, error) {
+	if !IsEncrypted(string(data)) {
+		return data, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(string(data), secretPrefix))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < ss.aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	nonce := sealed[:ss.aead.NonceSize()]
+	return ss.aead.Open(nil, nonce, sealed[ss.aead.NonceSize():], nil)
+}
+
+func (ss *SecretStore) Encrypt(plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	sealed, err := ss.Seal([]byte(plain))
+	return string(sealed), err
+}
+
+func (ss *SecretStore) Decrypt(value string) (string, error) {
+	plain, err := ss.Open([]byte(value))
+	return string(plain), err
+}
+
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, secretPrefix)
+}
@@ -0,0 +1,196 @@
+package model
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSecret = "s3cret-value"
+
+// newTestWorkDir returns a temporary work dir with empty config and state files.
+func newTestWorkDir(t *testing.T) string {
+	workDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(workDir, "data"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"config.json", "state.json"} {
+		if err := ioutil.WriteFile(filepath.Join(workDir, "data", name), []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return workDir
+}
+
+func newTestSecretStore(t *testing.T, workDir string) *SecretStore {
+	secrets, err := NewSecretStore(filepath.Join(workDir, "data", "secret.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secrets
+}
+
+// secretFile is a file with secrets, written and read back the way the app does it. A nil secret store stands for an
+// older version that saved plain text.
+type secretFile struct {
+	name  string
+	write func(t *testing.T, workDir string, secrets *SecretStore)
+	read  func(t *testing.T, workDir string, secrets *SecretStore) []string
+}
+
+var secretFiles = []secretFile{
+	{
+		name: "config.json",
+		write: func(t *testing.T, workDir string, secrets *SecretStore) {
+			configs := NewConfigs(workDir)
+			if secrets != nil {
+				configs.UseSecretStore(secrets)
+			}
+			configs.AccessToken = testSecret
+			configs.LockPin = testSecret
+			configs.LockPins = map[string]PinCode{"CDEF GHIJ": testSecret}
+			configs.AlarmPin = testSecret
+			if err := configs.SaveToFile(); err != nil {
+				t.Fatal(err)
+			}
+		},
+		read: func(t *testing.T, workDir string, secrets *SecretStore) []string {
+			configs := NewConfigs(workDir)
+			configs.UseSecretStore(secrets)
+			if err := configs.LoadFromFile(); err != nil {
+				t.Fatal(err)
+			}
+			return []string{configs.AccessToken, string(configs.LockPin), string(configs.LockPins["CDEF GHIJ"]), string(configs.AlarmPin)}
+		},
+	},
+	{
+		name: "state.json",
+		write: func(t *testing.T, workDir string, secrets *SecretStore) {
+			states := NewStates(workDir)
+			if secrets != nil {
+				states.UseSecretStore(secrets)
+			}
+			states.Username = testSecret
+			states.Password = testSecret
+			states.Trust = &TrustToken{Username: testSecret, Cookie: &http.Cookie{Name: "vs-trust", Value: testSecret}}
+			if err := states.SaveToFile(); err != nil {
+				t.Fatal(err)
+			}
+		},
+		read: func(t *testing.T, workDir string, secrets *SecretStore) []string {
+			states := NewStates(workDir)
+			states.UseSecretStore(secrets)
+			if err := states.LoadFromFile(); err != nil {
+				t.Fatal(err)
+			}
+			return []string{states.Username, states.Password, states.Trust.Username, states.Trust.Cookie.Value}
+		},
+	},
+	{
+		name: "session.json",
+		write: func(t *testing.T, workDir string, secrets *SecretStore) {
+			states := NewStates(workDir)
+			if secrets != nil {
+				states.UseSecretStore(secrets)
+			}
+			u, _ := url.Parse("https://automation01.verisure.com/graphql")
+			states.Session.SetCookies(u, []*http.Cookie{{Name: "vs-access", Value: testSecret}})
+		},
+		read: func(t *testing.T, workDir string, secrets *SecretStore) []string {
+			states := NewStates(workDir)
+			states.UseSecretStore(secrets)
+			if err := states.LoadFromFile(); err != nil {
+				t.Fatal(err)
+			}
+			if cookie := states.GetCookieByName("vs-access"); cookie != nil {
+				return []string{cookie.Value}
+			}
+			return []string{""}
+		},
+	},
+}
+
+func TestStoredSecrets(t *testing.T) {
+	tests := []struct {
+		name string
+		// plain saves the file without encryption, as older versions did.
+		plain bool
+		// replaceKey loads the file with a new key file.
+		replaceKey bool
+		want       string
+	}{
+		{"read back with the same key", false, false, testSecret},
+		{"dropped with a replaced key", false, true, ""},
+		{"plain text from older versions", true, false, testSecret},
+	}
+	for _, file := range secretFiles {
+		for _, tt := range tests {
+			t.Run(file.name+" "+tt.name, func(t *testing.T) {
+				workDir := newTestWorkDir(t)
+				secrets := newTestSecretStore(t, workDir)
+				if tt.plain {
+					file.write(t, workDir, nil)
+				} else {
+					file.write(t, workDir, secrets)
+				}
+				if tt.replaceKey {
+					if err := os.Remove(filepath.Join(workDir, "data", "secret.key")); err != nil {
+						t.Fatal(err)
+					}
+					secrets = newTestSecretStore(t, workDir)
+				}
+
+				got := file.read(t, workDir, secrets)
+				for i := range got {
+					if got[i] != tt.want {
+						t.Errorf("got secrets %q, want %q", got, tt.want)
+						break
+					}
+				}
+
+				body, err := ioutil.ReadFile(filepath.Join(workDir, "data", file.name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.Contains(string(body), testSecret) {
+					t.Errorf("%s holds a secret in plain text: %s", file.name, body)
+				}
+				// Loading again reads what the first load saved.
+				if again := file.read(t, workDir, secrets); !reflect.DeepEqual(again, got) {
+					t.Errorf("got secrets %q on the second load, want %q", again, got)
+				}
+			})
+		}
+	}
+}
+
+func TestSessionFileIsEncrypted(t *testing.T) {
+	workDir := newTestWorkDir(t)
+	secrets := newTestSecretStore(t, workDir)
+	path := filepath.Join(workDir, "data", "session.json")
+	session := NewSessionStore(path)
+	session.UseSecretStore(secrets)
+	u, _ := url.Parse("https://automation01.verisure.com/graphql")
+	session.SetCookies(u, []*http.Cookie{{Name: "vs-access", Value: testSecret}})
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(string(body)) {
+		t.Errorf("session file isn't encrypted: %s", body)
+	}
+	session = NewSessionStore(path)
+	session.UseSecretStore(secrets)
+	if err := session.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if session.IsPlain() {
+		t.Error("encrypted session file read as plain text")
+	}
+}
@@ -0,0 +1,317 @@
+package model
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/futurehomeno/fimpgo/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionCookie is a cookie as stored in the session file, with the attributes needed to decide where it is sent.
+type SessionCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain"`
+	Path     string    `json:"path"`
+	Expires  time.Time `json:"expires"`
+	HostOnly bool      `json:"host_only"`
+	Secure   bool      `json:"secure"`
+	HttpOnly bool      `json:"http_only"`
+}
+
+func (sc *SessionCookie) key() string {
+	return sc.Domain + ";" + sc.Path + ";" + sc.Name
+}
+
+func (sc *SessionCookie) isExpired(now time.Time) bool {
+	return !sc.Expires.IsZero() && !now.Before(sc.Expires)
+}
+
+func (sc *SessionCookie) cookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     sc.Name,
+		Value:    sc.Value,
+		Domain:   sc.Domain,
+		Path:     sc.Path,
+		Expires:  sc.Expires,
+		Secure:   sc.Secure,
+		HttpOnly: sc.HttpOnly,
+	}
+}
+
+// SessionStore is a cookie jar for the Verisure session that is saved to disk whenever it changes.
+type SessionStore struct {
+	mu      sync.Mutex
+	path    string
+	secrets *SecretStore
+	plain   bool
+	cookies map[string]*SessionCookie
+}
+
+func NewSessionStore(path string) *SessionStore {
+	return &SessionStore{path: path, cookies: map[string]*SessionCookie{}}
+}
+
+func (ss *SessionStore) LoadFromFile() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if !utils.FileExists(ss.path) {
+		return nil
+	}
+	body, err := ioutil.ReadFile(ss.path)
+	if err != nil {
+		return err
+	}
+	if ss.secrets != nil {
+		ss.plain = !IsEncrypted(string(body))
+		if body, err = ss.secrets.Open(body); err != nil {
+			log.Error("Can't decrypt session file, a new login is needed: ", err)
+			ss.cookies = map[string]*SessionCookie{}
+			return nil
+		}
+	}
+
+	var cookies []*SessionCookie
+	if err := json.Unmarshal(body, &cookies); err != nil {
+		return err
+	}
+	ss.cookies = map[string]*SessionCookie{}
+	for _, cookie := range cookies {
+		ss.cookies[cookie.key()] = cookie
+	}
+	return nil
+}
+
+func (ss *SessionStore) SaveToFile() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.save()
+}
+
+func (ss *SessionStore) save() error {
+	cookies := []*SessionCookie{}
+	for _, cookie := range ss.cookies {
+		cookies = append(cookies, cookie)
+	}
+	body, err := json.Marshal(cookies)
+	if err != nil {
+		return err
+	}
+	if ss.secrets != nil {
+		if body, err = ss.secrets.Seal(body); err != nil {
+			return err
+		}
+		ss.plain = false
+	}
+	if err := ioutil.WriteFile(ss.path, body, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(ss.path, 0600)
+}
+
+// UseSecretStore makes the session store encrypt the session file.
+func (ss *SessionStore) UseSecretStore(secrets *SecretStore) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.secrets = secrets
+}
+
+// IsPlain returns true if the session file was read as plain text and should be saved again to encrypt it.
+func (ss *SessionStore) IsPlain() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.plain && len(ss.cookies) > 0
+}
+
+// SetCookies stores the cookies from a response to u and saves the session if anything changed.
+func (ss *SessionStore) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	if len(cookies) == 0 {
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	host := canonicalHost(u.Host)
+	now := time.Now()
+	changed := false
+	for _, cookie := range cookies {
+		sc := &SessionCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Expires:  cookie.Expires,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+		}
+
+		domain := strings.TrimPrefix(strings.ToLower(cookie.Domain), ".")
+		if domain == "" {
+			sc.Domain = host
+			sc.HostOnly = true
+		} else if domainMatch(host, domain) {
+			sc.Domain = domain
+		} else {
+			continue
+		}
+
+		if sc.Path == "" || !strings.HasPrefix(sc.Path, "/") {
+			sc.Path = defaultPath(u.Path)
+		}
+
+		if cookie.MaxAge < 0 {
+			sc.Expires = now.Add(-time.Second)
+		} else if cookie.MaxAge > 0 {
+			sc.Expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		}
+
+		if sc.isExpired(now) {
+			if _, ok := ss.cookies[sc.key()]; ok {
+				delete(ss.cookies, sc.key())
+				changed = true
+			}
+			continue
+		}
+
+		if old, ok := ss.cookies[sc.key()]; ok && *old == *sc {
+			continue
+		}
+		ss.cookies[sc.key()] = sc
+		changed = true
+	}
+
+	if changed && ss.path != "" {
+		if err := ss.save(); err != nil {
+			log.Error("Can't save session file: ", err)
+		}
+	}
+}
+
+// Cookies returns the unexpired cookies to send with a request to u.
+func (ss *SessionStore) Cookies(u *url.URL) []*http.Cookie {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	host := canonicalHost(u.Host)
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	now := time.Now()
+
+	var cookies []*http.Cookie
+	for _, sc := range ss.cookies {
+		if sc.isExpired(now) {
+			continue
+		}
+		if sc.HostOnly && sc.Domain != host || !sc.HostOnly && !domainMatch(host, sc.Domain) {
+			continue
+		}
+		if !pathMatch(path, sc.Path) {
+			continue
+		}
+		if sc.Secure && u.Scheme != "https" {
+			continue
+		}
+		cookies = append(cookies, &http.Cookie{Name: sc.Name, Value: sc.Value})
+	}
+	return cookies
+}
+
+// Get returns the cookie with the given name regardless of domain, including an expired one, or nil.
+func (ss *SessionStore) Get(name string) *http.Cookie {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var found *SessionCookie
+	for _, sc := range ss.cookies {
+		if sc.Name == name && (found == nil || sc.Expires.After(found.Expires)) {
+			found = sc
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	return found.cookie()
+}
+
+// Import adds cookies that were stored without a domain, e.g. from an older state file, for each of the hosts.
+func (ss *SessionStore) Import(cookies []*http.Cookie, hosts []string) {
+	for _, host := range hosts {
+		u, err := url.Parse(host)
+		if err != nil {
+			continue
+		}
+		imported := []*http.Cookie{}
+		for _, cookie := range cookies {
+			c := *cookie
+			c.Domain = ""
+			c.Path = "/"
+			imported = append(imported, &c)
+		}
+		ss.SetCookies(u, imported)
+	}
+}
+
+func (ss *SessionStore) Clear() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.cookies = map[string]*SessionCookie{}
+	if ss.path == "" {
+		return nil
+	}
+	err := os.Remove(ss.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (ss *SessionStore) IsEmpty() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.cookies) == 0
+}
+
+func canonicalHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func domainMatch(host string, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func pathMatch(requestPath string, cookiePath string) bool {
+	if requestPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(requestPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || requestPath[len(cookiePath)] == '/'
+}
+
+// defaultPath is the path a cookie without a Path attribute applies to, see RFC 6265 section 5.1.4.
+func defaultPath(requestPath string) string {
+	if requestPath == "" || requestPath[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndex(requestPath, "/")
+	if i == 0 {
+		return "/"
+	}
+	return requestPath[:i]
+}
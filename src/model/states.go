@@ -7,7 +7,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/futurehomeno/fimpgo/utils"
@@ -15,7 +15,9 @@ import (
 )
 
 type States struct {
+	mu           *sync.Mutex
 	path         string
+	secrets      *SecretStore
 	LogFile      string `json:"log_file"`
 	LogLevel     string `json:"log_level"`
 	LogFormat    string `json:"log_format"`
@@ -23,19 +25,39 @@ type States struct {
 	ConfiguredAt string `json:"configuret_at"`
 	ConfiguredBy string `json:"configures_by"`
 
-	Cookies  []*http.Cookie `json:"cookies"`
+	// Cookies is only read to move sessions from older state files into Session.
+	Cookies  []*http.Cookie `json:"cookies,omitempty"`
+	Session  *SessionStore  `json:"-"`
 	Username string         `json:"username"`
+	Password string         `json:"password,omitempty"`
 	GIID     string         `json:"giid"`
+	Trust    *TrustToken    `json:"trust"`
 
 	Installations []Installation     `json:"installations"`
 	Climates      []ClimateDevice    `json:"climates"`
 	DoorWindows   []DoorWindowDevice `json:"doorWindows"`
 	SmartLocks    []SmartLockDevice  `json:"smartLocks"`
+	SmartPlugs    []SmartPlugDevice  `json:"smartPlugs"`
+	ArmState      *ArmState          `json:"armState"`
+	PolledAt      time.Time          `json:"polledAt"`
+
+	// IgnoredDevices holds the addresses of devices deleted from Futurehome, which are left out until included again.
+	IgnoredDevices []string `json:"ignoredDevices,omitempty"`
+
+	// Addresses maps the device labels to the FIMP addresses the devices were included with.
+	Addresses *AddressRegistry `json:"addresses"`
+}
+
+// TrustToken is handed out by Verisure after a successful MFA challenge and lets later logins for the same user skip it.
+type TrustToken struct {
+	Username string       `json:"username"`
+	Cookie   *http.Cookie `json:"cookie"`
 }
 
 func NewStates(workDir string) *States {
-	state := &States{WorkDir: workDir}
+	state := &States{mu: &sync.Mutex{}, WorkDir: workDir, Addresses: NewAddressRegistry()}
 	state.path = filepath.Join(workDir, "data", "state.json")
+	state.Session = NewSessionStore(filepath.Join(workDir, "data", "session.json"))
 	if !utils.FileExists(state.path) {
 		log.Info("State file doesn't exist.Loading default state")
 		defaultStateFile := filepath.Join(workDir, "defaults", "state.json")
@@ -48,23 +70,48 @@ func NewStates(workDir string) *States {
 	return state
 }
 
+// Lock serializes the goroutines that use the states: the FIMP router, the poller, the session keeper and the Verisure
+// client hold it while they read or write the states, but not while they wait for Verisure. The methods of States don't
+// take it themselves.
+func (st *States) Lock() {
+	st.mu.Lock()
+}
+
+func (st *States) Unlock() {
+	st.mu.Unlock()
+}
+
+// ClearState forgets the session and the cached devices. The addresses and the ignored devices are kept, since the
+// devices stay in Futurehome with those addresses; ClearAddresses forgets them once the devices are excluded.
 func (st *States) ClearState() error {
 	st.Cookies = nil
+	if err := st.Session.Clear(); err != nil {
+		return err
+	}
 	st.Username = ""
+	st.Password = ""
 	st.GIID = ""
 
 	st.Installations = nil
 	st.Climates = nil
 	st.DoorWindows = nil
 	st.SmartLocks = nil
+	st.SmartPlugs = nil
+	st.ArmState = nil
+	st.PolledAt = time.Time{}
 
 	return st.SaveToFile()
 }
 
+// ClearAddresses forgets the device addresses and the ignored devices, when the devices are excluded from Futurehome.
+func (st *States) ClearAddresses() {
+	st.Addresses = NewAddressRegistry()
+	st.IgnoredDevices = nil
+}
+
 func (st *States) GetClimateByDeviceLabel(deviceLabel string) *ClimateDevice {
-	deviceLabel = strings.ReplaceAll(deviceLabel, " ", "")
 	for _, climate := range st.Climates {
-		if deviceLabel == strings.ReplaceAll(climate.Device.DeviceLabel, " ", "") {
+		if deviceLabel == climate.Device.DeviceLabel {
 			return &climate
 		}
 	}
@@ -72,9 +119,8 @@ func (st *States) GetClimateByDeviceLabel(deviceLabel string) *ClimateDevice {
 }
 
 func (st *States) GetDoorWindowByDeviceLabel(deviceLabel string) *DoorWindowDevice {
-	deviceLabel = strings.ReplaceAll(deviceLabel, " ", "")
 	for _, doorWindow := range st.DoorWindows {
-		if deviceLabel == strings.ReplaceAll(doorWindow.Device.DeviceLabel, " ", "") {
+		if deviceLabel == doorWindow.Device.DeviceLabel {
 			return &doorWindow
 		}
 	}
@@ -82,24 +128,163 @@ func (st *States) GetDoorWindowByDeviceLabel(deviceLabel string) *DoorWindowDevi
 }
 
 func (st *States) GetSmartLockByDeviceLabel(deviceLabel string) *SmartLockDevice {
-	deviceLabel = strings.ReplaceAll(deviceLabel, " ", "")
 	for _, smartLock := range st.SmartLocks {
-		if deviceLabel == strings.ReplaceAll(smartLock.Device.DeviceLabel, " ", "") {
+		if deviceLabel == smartLock.Device.DeviceLabel {
 			return &smartLock
 		}
 	}
 	return nil
 }
 
-func (st *States) GetCookieByName(name string) *http.Cookie {
-	for _, cookie := range st.Cookies {
-		if name == cookie.Name {
-			return cookie
+func (st *States) GetSmartPlugByDeviceLabel(deviceLabel string) *SmartPlugDevice {
+	for _, smartPlug := range st.SmartPlugs {
+		if deviceLabel == smartPlug.Device.DeviceLabel {
+			return &smartPlug
 		}
 	}
 	return nil
 }
 
+// GetThingAddresses returns the addresses of the things reported for the cached devices, without the alarm panel.
+func (st *States) GetThingAddresses() []string {
+	var labels []string
+	for _, climate := range st.Climates {
+		labels = append(labels, climate.Device.DeviceLabel)
+	}
+	for _, doorWindow := range st.DoorWindows {
+		labels = append(labels, doorWindow.Device.DeviceLabel)
+	}
+	for _, smartLock := range st.SmartLocks {
+		labels = append(labels, smartLock.Device.DeviceLabel)
+	}
+	for _, smartPlug := range st.SmartPlugs {
+		labels = append(labels, smartPlug.Device.DeviceLabel)
+	}
+
+	addresses := []string{}
+	for _, label := range labels {
+		addresses = append(addresses, st.GetAddress(label))
+	}
+	return addresses
+}
+
+// GetAddress returns the FIMP address of the device with the label, assigning one if the device is new.
+func (st *States) GetAddress(deviceLabel string) string {
+	return st.Addresses.GetAddress(deviceLabel)
+}
+
+// GetDeviceLabel returns the label of the device with the FIMP address, or an empty string if the address is unknown.
+func (st *States) GetDeviceLabel(address string) string {
+	return st.Addresses.GetDeviceLabel(address)
+}
+
+// IsFresh returns true if the devices were polled less than maxAge ago.
+func (st *States) IsFresh(maxAge time.Duration) bool {
+	return !st.PolledAt.IsZero() && time.Since(st.PolledAt) < maxAge
+}
+
+// IsIgnored returns true if the device with the address was deleted from Futurehome.
+func (st *States) IsIgnored(address string) bool {
+	for _, ignored := range st.IgnoredDevices {
+		if ignored == address {
+			return true
+		}
+	}
+	return false
+}
+
+// IgnoreDevice leaves the device out from now on and drops it from the cached devices.
+func (st *States) IgnoreDevice(address string) {
+	if !st.IsIgnored(address) {
+		st.IgnoredDevices = append(st.IgnoredDevices, address)
+	}
+
+	cached := &Installation{Climates: st.Climates, DoorWindows: st.DoorWindows, SmartLocks: st.SmartLocks, SmartPlugs: st.SmartPlugs}
+	st.RemoveIgnored(cached)
+	st.Climates = cached.Climates
+	st.DoorWindows = cached.DoorWindows
+	st.SmartLocks = cached.SmartLocks
+	st.SmartPlugs = cached.SmartPlugs
+}
+
+// IncludeDevice stops ignoring a device. It returns false if the device wasn't ignored.
+func (st *States) IncludeDevice(address string) bool {
+	for i, ignored := range st.IgnoredDevices {
+		if ignored == address {
+			st.IgnoredDevices = append(st.IgnoredDevices[:i], st.IgnoredDevices[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveIgnored drops the ignored devices from the device lists of an installation. Lists that are nil stay nil.
+func (st *States) RemoveIgnored(installation *Installation) {
+	if len(st.IgnoredDevices) == 0 {
+		return
+	}
+	if installation.Climates != nil {
+		climates := []ClimateDevice{}
+		for _, climate := range installation.Climates {
+			if !st.IsIgnored(st.GetAddress(climate.Device.DeviceLabel)) {
+				climates = append(climates, climate)
+			}
+		}
+		installation.Climates = climates
+	}
+	if installation.DoorWindows != nil {
+		doorWindows := []DoorWindowDevice{}
+		for _, doorWindow := range installation.DoorWindows {
+			if !st.IsIgnored(st.GetAddress(doorWindow.Device.DeviceLabel)) {
+				doorWindows = append(doorWindows, doorWindow)
+			}
+		}
+		installation.DoorWindows = doorWindows
+	}
+	if installation.SmartLocks != nil {
+		smartLocks := []SmartLockDevice{}
+		for _, smartLock := range installation.SmartLocks {
+			if !st.IsIgnored(st.GetAddress(smartLock.Device.DeviceLabel)) {
+				smartLocks = append(smartLocks, smartLock)
+			}
+		}
+		installation.SmartLocks = smartLocks
+	}
+	if installation.SmartPlugs != nil {
+		smartPlugs := []SmartPlugDevice{}
+		for _, smartPlug := range installation.SmartPlugs {
+			if !st.IsIgnored(st.GetAddress(smartPlug.Device.DeviceLabel)) {
+				smartPlugs = append(smartPlugs, smartPlug)
+			}
+		}
+		installation.SmartPlugs = smartPlugs
+	}
+}
+
+func (st *States) GetInstallationByGIID(giid string) *Installation {
+	for _, installation := range st.Installations {
+		if giid == installation.Giid {
+			return &installation
+		}
+	}
+	return nil
+}
+
+// GetTrustCookie returns the stored trust cookie for the user, or nil if there is none or it has expired.
+func (st *States) GetTrustCookie(username string) *http.Cookie {
+	if st.Trust == nil || st.Trust.Cookie == nil || st.Trust.Username != username {
+		return nil
+	}
+	if !st.Trust.Cookie.Expires.IsZero() && time.Now().After(st.Trust.Cookie.Expires) {
+		return nil
+	}
+	return st.Trust.Cookie
+}
+
+func (st *States) GetCookieByName(name string) *http.Cookie {
+	return st.Session.Get(name)
+}
+
 func (st *States) LoadFromFile() error {
 	stateFileBody, err := ioutil.ReadFile(st.path)
 	if err != nil {
@@ -109,21 +294,143 @@ func (st *States) LoadFromFile() error {
 	if err != nil {
 		return err
 	}
+	if err := st.Session.LoadFromFile(); err != nil {
+		return err
+	}
+
+	save := false
+	if st.Addresses == nil {
+		st.Addresses = NewAddressRegistry()
+	}
+	// State files from older versions have no registry, the cached devices keep the addresses they were included with.
+	if st.Addresses.IsEmpty() && len(st.GetThingAddresses()) > 0 {
+		log.Info("Registering addresses of cached devices")
+		save = true
+	}
+
+	if st.secrets != nil {
+		if st.Session.IsPlain() {
+			log.Info("Encrypting session file")
+			if err := st.Session.SaveToFile(); err != nil {
+				return err
+			}
+		}
+		if st.decryptSecrets() {
+			log.Info("Encrypting secrets in state file")
+			save = true
+		}
+	}
+	if save {
+		return st.SaveToFile()
+	}
 	return nil
 }
 
+// MigrateCookies moves cookies from an older state file into the session store, for the given API hosts.
+func (st *States) MigrateCookies(hosts []string) error {
+	if len(st.Cookies) == 0 {
+		return nil
+	}
+	if st.Session.IsEmpty() {
+		log.Info("Moving Verisure session cookies to the session store")
+		st.Session.Import(st.Cookies, hosts)
+	}
+	st.Cookies = nil
+	return st.SaveToFile()
+}
+
 func (st *States) SaveToFile() error {
 	st.ConfiguredBy = "auto"
 	st.ConfiguredAt = time.Now().Format(time.RFC3339)
-	bpayload, err := json.Marshal(st)
+	bpayload, err := st.marshal()
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(st.path, bpayload, 0600)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(st.path, bpayload, 0664)
+	return os.Chmod(st.path, 0600)
+}
+
+// UseSecretStore makes the states encrypt the credentials, the trust cookie and the session file.
+func (st *States) UseSecretStore(secrets *SecretStore) {
+	st.secrets = secrets
+	st.Session.UseSecretStore(secrets)
+}
+
+// marshal returns the states as they are saved, with the secrets encrypted.
+func (st *States) marshal() ([]byte, error) {
+	if st.secrets == nil {
+		return json.Marshal(st)
+	}
+	username, password, trust := st.Username, st.Password, st.Trust
+	defer func() {
+		st.Username, st.Password, st.Trust = username, password, trust
+	}()
+	if err := st.encryptSecrets(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(st)
+}
+
+// encryptSecrets replaces the secrets with encrypted ones while the states are marshalled.
+func (st *States) encryptSecrets() error {
+	username, err := st.secrets.Encrypt(st.Username)
 	if err != nil {
 		return err
 	}
-	return err
+	st.Username = username
+	if st.Password, err = st.secrets.Encrypt(st.Password); err != nil {
+		return err
+	}
+
+	if st.Trust != nil {
+		trust := TrustToken{}
+		if trust.Username, err = st.secrets.Encrypt(st.Trust.Username); err != nil {
+			return err
+		}
+		if st.Trust.Cookie != nil {
+			cookie := *st.Trust.Cookie
+			if cookie.Value, err = st.secrets.Encrypt(cookie.Value); err != nil {
+				return err
+			}
+			trust.Cookie = &cookie
+		}
+		st.Trust = &trust
+	}
+	return nil
+}
+
+// decryptSecrets decrypts the secrets read from the state file and returns true if any of them was stored as plain text.
+// A secret that can't be decrypted, e.g. because the key file was replaced, is dropped.
+func (st *States) decryptSecrets() bool {
+	plain := false
+	decrypt := func(value string) string {
+		if value == "" {
+			return ""
+		}
+		if !IsEncrypted(value) {
+			plain = true
+			return value
+		}
+		decrypted, err := st.secrets.Decrypt(value)
+		if err != nil {
+			log.Error("Can't decrypt secret in state file: ", err)
+			return ""
+		}
+		return decrypted
+	}
+
+	st.Username = decrypt(st.Username)
+	st.Password = decrypt(st.Password)
+	if st.Trust != nil {
+		st.Trust.Username = decrypt(st.Trust.Username)
+		if st.Trust.Cookie != nil {
+			st.Trust.Cookie.Value = decrypt(st.Trust.Cookie.Value)
+		}
+	}
+	return plain
 }
 
 func (st *States) GetDataDir() string {
@@ -0,0 +1,108 @@
+package model
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddressMigration(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+		want  map[string]string
+	}{
+		{
+			name:  "cached devices keep their addresses",
+			state: `{"climates": [{"device": {"deviceLabel": "ABCD EFGH"}}], "smartLocks": [{"device": {"deviceLabel": "CDEF GHIJ"}}]}`,
+			want:  map[string]string{"ABCD EFGH": "ABCDEFGH", "CDEF GHIJ": "CDEFGHIJ"},
+		},
+		{
+			name:  "labels that were mangled to the same address",
+			state: `{"climates": [{"device": {"deviceLabel": "ABCD EFGH"}}], "doorWindows": [{"device": {"deviceLabel": "ABCDE FGH"}}], "smartPlugs": [{"device": {"deviceLabel": "AB CDEFGH"}}]}`,
+			want:  map[string]string{"ABCD EFGH": "ABCDEFGH", "ABCDE FGH": "ABCDEFGH_2", "AB CDEFGH": "ABCDEFGH_3"},
+		},
+		{
+			name:  "registry from a newer version",
+			state: `{"climates": [{"device": {"deviceLabel": "ABCD EFGH"}}], "addresses": {"ABCD EFGH": "ABCDEFGH_2", "ABCDE FGH": "ABCDEFGH"}}`,
+			want:  map[string]string{"ABCD EFGH": "ABCDEFGH_2", "ABCDE FGH": "ABCDEFGH"},
+		},
+		{
+			name:  "no cached devices",
+			state: `{}`,
+			want:  map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := newTestWorkDir(t)
+			path := filepath.Join(workDir, "data", "state.json")
+			if err := ioutil.WriteFile(path, []byte(tt.state), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, load := range []string{"first", "second"} {
+				states := NewStates(workDir)
+				if err := states.LoadFromFile(); err != nil {
+					t.Fatal(err)
+				}
+				for deviceLabel, address := range tt.want {
+					if got := states.GetDeviceLabel(address); got != deviceLabel {
+						t.Errorf("%s load: address %s belongs to %q, want %q", load, address, got, deviceLabel)
+					}
+				}
+				if !states.Addresses.IsEmpty() && len(tt.want) == 0 {
+					t.Errorf("%s load: addresses registered without cached devices", load)
+				}
+			}
+		})
+	}
+}
+
+func TestNewDeviceAfterMigration(t *testing.T) {
+	workDir := newTestWorkDir(t)
+	path := filepath.Join(workDir, "data", "state.json")
+	if err := ioutil.WriteFile(path, []byte(`{"climates": [{"device": {"deviceLabel": "ABCD EFGH"}}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	states := NewStates(workDir)
+	if err := states.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if address := states.GetAddress("ABCDE FGH"); address != "ABCDEFGH_2" {
+		t.Errorf("new device got address %s, want ABCDEFGH_2", address)
+	}
+	if address := states.GetAddress("ABCD EFGH"); address != "ABCDEFGH" {
+		t.Errorf("cached device got address %s, want ABCDEFGH", address)
+	}
+}
+
+func TestClearAddresses(t *testing.T) {
+	workDir := newTestWorkDir(t)
+	states := NewStates(workDir)
+	if err := states.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	address := states.GetAddress("ABCD EFGH")
+	states.IgnoreDevice(address)
+
+	if err := states.ClearState(); err != nil {
+		t.Fatal(err)
+	}
+	if states.GetDeviceLabel(address) == "" || !states.IsIgnored(address) {
+		t.Error("ClearState forgot the addresses of devices that are still in Futurehome")
+	}
+
+	states.ClearAddresses()
+	if err := states.SaveToFile(); err != nil {
+		t.Fatal(err)
+	}
+	states = NewStates(workDir)
+	if err := states.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if states.GetDeviceLabel(address) != "" || states.IsIgnored(address) {
+		t.Error("addresses and ignored devices kept after ClearAddresses")
+	}
+}
@@ -1,6 +1,11 @@
 package model
 
-import "time"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type ErrorLocation struct {
 	Line   int `json:"line"`
@@ -85,15 +90,175 @@ type User struct {
 }
 
 type SmartLockDevice struct {
-	LockStatus   string    `json:"lockStatus"`
-	DoorState    string    `json:"doorState"`
-	LockMethod   string    `json:"lockMethod"`
-	EventTime    time.Time `json:"eventTime"`
-	DoorLockType string    `json:"doorLockType"`
-	SecureMode   string    `json:"secureMode"`
-	Device       Device    `json:"device"`
-	User         User      `json:"user"`
-	Typename     string    `json:"__typename"`
+	LockStatus    string                  `json:"lockStatus"`
+	DoorState     string                  `json:"doorState"`
+	LockMethod    string                  `json:"lockMethod"`
+	EventTime     time.Time               `json:"eventTime"`
+	DoorLockType  string                  `json:"doorLockType"`
+	SecureMode    string                  `json:"secureMode"`
+	Device        Device                  `json:"device"`
+	User          User                    `json:"user"`
+	Configuration *SmartLockConfiguration `json:"configuration,omitempty"`
+	Typename      string                  `json:"__typename"`
+}
+
+// SmartLockConfiguration holds the settings of a Yale Doorman lock. It is only fetched by FetchSmartLockConfig,
+// and unset fields are left unchanged when updating.
+type SmartLockConfiguration struct {
+	AutoLockEnabled *bool  `json:"autoLockEnabled,omitempty"`
+	Volume          string `json:"volume,omitempty"`
+	VoiceLevel      string `json:"voiceLevel,omitempty"`
+	Typename        string `json:"__typename,omitempty"`
+}
+
+// Supported values of the lock configuration parameters.
+var (
+	LockVolumes     = []string{"SILENCE", "LOW", "HIGH"}
+	LockVoiceLevels = []string{"ESSENTIAL", "NORMAL"}
+)
+
+// GetFimpValue returns the configuration as the str_map used by evt.config.report on door_lock.
+func (lc *SmartLockConfiguration) GetFimpValue() map[string]string {
+	val := map[string]string{}
+	if lc.AutoLockEnabled != nil {
+		val["auto_lock"] = strconv.FormatBool(*lc.AutoLockEnabled)
+	}
+	if lc.Volume != "" {
+		val["volume"] = strings.ToLower(lc.Volume)
+	}
+	if lc.VoiceLevel != "" {
+		val["voice_level"] = strings.ToLower(lc.VoiceLevel)
+	}
+	return val
+}
+
+// NewSmartLockConfiguration parses the str_map of cmd.config.set on door_lock. Parameters that are not set are left nil or empty.
+func NewSmartLockConfiguration(params map[string]string) (*SmartLockConfiguration, error) {
+	lc := &SmartLockConfiguration{}
+	for name, value := range params {
+		switch name {
+		case "auto_lock":
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auto_lock value %q", value)
+			}
+			lc.AutoLockEnabled = &enabled
+		case "volume":
+			if !contains(LockVolumes, strings.ToUpper(value)) {
+				return nil, fmt.Errorf("invalid volume %q", value)
+			}
+			lc.Volume = strings.ToUpper(value)
+		case "voice_level":
+			if !contains(LockVoiceLevels, strings.ToUpper(value)) {
+				return nil, fmt.Errorf("invalid voice_level %q", value)
+			}
+			lc.VoiceLevel = strings.ToUpper(value)
+		default:
+			return nil, fmt.Errorf("unknown lock configuration parameter %q", name)
+		}
+	}
+	return lc, nil
+}
+
+func toLower(values []string) []string {
+	lower := []string{}
+	for _, v := range values {
+		lower = append(lower, strings.ToLower(v))
+	}
+	return lower
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	LockStatusLocked   = "LOCKED"
+	LockStatusUnlocked = "UNLOCKED"
+	LockStatusPending  = "PENDING"
+	LockStatusJammed   = "JAMMED"
+	LockStatusUnknown  = "UNKNOWN"
+)
+
+// FimpLockMethods maps Verisure lock methods to the values of the lock_method property.
+var FimpLockMethods = map[string]string{
+	"CODE":       "pin",
+	"THUMBLATCH": "thumb_turn",
+	"THUMB":      "thumb_turn",
+	"KEY":        "key",
+	"REMOTE":     "remote",
+	"AUTO":       "auto_lock",
+	"AUTO_LOCK":  "auto_lock",
+	"TAG":        "tag",
+	"BLUETOOTH":  "bluetooth",
+}
+
+// GetLockState returns the door_lock state. is_secured and door_is_closed are only set when they are known.
+func (sl *SmartLockDevice) GetLockState() *LockState {
+	state := &LockState{}
+	switch sl.LockStatus {
+	case LockStatusLocked:
+		isSecured := true
+		state.IsSecured = &isSecured
+	case LockStatusUnlocked:
+		isSecured := false
+		state.IsSecured = &isSecured
+	}
+	switch sl.DoorState {
+	case "CLOSE", "CLOSED":
+		doorIsClosed := true
+		state.DoorIsClosed = &doorIsClosed
+	case "OPEN":
+		doorIsClosed := false
+		state.DoorIsClosed = &doorIsClosed
+	}
+	return state
+}
+
+// GetReportProps returns the lock status, how the lock was last operated and by whom.
+func (sl *SmartLockDevice) GetReportProps() map[string]string {
+	props := map[string]string{
+		"lock_status": sl.GetFimpLockStatus(),
+		"lock_type":   "KEY",
+		"lock_method": "unknown",
+	}
+	if sl.LockMethod == "CODE" {
+		props["lock_type"] = "PIN"
+	}
+	if method, ok := FimpLockMethods[sl.LockMethod]; ok {
+		props["lock_method"] = method
+	}
+	if sl.User.Name != "" {
+		props["user"] = sl.User.Name
+	}
+	return props
+}
+
+// GetFimpLockStatus returns the lock status as reported in the lock_status property.
+func (sl *SmartLockDevice) GetFimpLockStatus() string {
+	switch sl.LockStatus {
+	case LockStatusLocked, LockStatusUnlocked, LockStatusPending, LockStatusJammed:
+		return strings.ToLower(sl.LockStatus)
+	}
+	return "unknown"
+}
+
+type SmartPlugDevice struct {
+	Device       Device `json:"device"`
+	CurrentState string `json:"currentState"`
+	Icon         string `json:"icon"`
+	IsHazardous  bool   `json:"isHazardous"`
+	Typename     string `json:"__typename"`
+}
+
+// IsOn returns true if the plug is switched on.
+func (sp *SmartPlugDevice) IsOn() bool {
+	return sp.CurrentState == "ON"
 }
 
 type ArmState struct {
@@ -105,6 +270,33 @@ type ArmState struct {
 	Typename   string      `json:"__typename"`
 }
 
+const (
+	ArmStateArmedAway = "ARMED_AWAY"
+	ArmStateArmedHome = "ARMED_HOME"
+	ArmStateDisarmed  = "DISARMED"
+)
+
+// FimpArmStates maps Verisure arm states to the values used by the alarm_panel service.
+var FimpArmStates = map[string]string{
+	ArmStateArmedAway: "armed_away",
+	ArmStateArmedHome: "armed_home",
+	ArmStateDisarmed:  "disarmed",
+}
+
+// GetFimpValue returns the alarm_panel value for the arm state, or an empty string if it is unknown.
+func (as *ArmState) GetFimpValue() string {
+	return FimpArmStates[as.StatusType]
+}
+
+// GetReportProps returns who changed the arm state and how.
+func (as *ArmState) GetReportProps() map[string]string {
+	return map[string]string{
+		"name":        as.Name,
+		"changed_via": as.ChangedVia,
+		"date":        as.Date.Format(time.RFC3339),
+	}
+}
+
 type UserTracking struct {
 	IsCallingUser            bool      `json:"isCallingUser"`
 	WebAccount               string    `json:"webAccount"`
@@ -132,6 +324,7 @@ type Installation struct {
 	Climates      []ClimateDevice    `json:"climates,omitempty"`
 	DoorWindows   []DoorWindowDevice `json:"doorWindows,omitempty"`
 	SmartLocks    []SmartLockDevice  `json:"smartLocks,omitempty"`
+	SmartPlugs    []SmartPlugDevice  `json:"smartplugs,omitempty"`
 	UserTrackings []UserTracking     `json:"userTrackings,omitempty"`
 	ArmState      *ArmState          `json:"armState,omitempty"`
 	Typename      string             `json:"__typename"`
@@ -143,3 +336,9 @@ type LockState struct {
 	BoltIsLocked  *bool `json:"bolt_is_locked,omitempty"`
 	LatchIsClosed *bool `json:"latch_is_closed,omitempty"`
 }
+
+// LockCommand is the object form of cmd.lock.set, used when the pin is entered in Futurehome.
+type LockCommand struct {
+	IsSecured bool   `json:"is_secured"`
+	Pin       string `json:"pin"`
+}
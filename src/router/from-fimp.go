@@ -1,6 +1,8 @@
 package router
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"strings"
@@ -8,12 +10,27 @@ import (
 
 	"github.com/futurehomeno/fimpgo"
 	"github.com/futurehomeno/fimpgo/edgeapp"
+	"github.com/futurehomeno/fimpgo/fimptype"
 	log "github.com/sirupsen/logrus"
 	"github.com/thingsplex/verisure/model"
 	"github.com/thingsplex/verisure/verisure"
 )
 
+// commandTimeout bounds the time spent handling a single FIMP command, including all requests to Verisure.
+const commandTimeout = 60 * time.Second
+
+// defaultLockConfirmTimeout bounds the wait for a smart lock to report the result of a lock or unlock.
+const defaultLockConfirmTimeout = 30 * time.Second
+
+// inclusionCacheMaxAge is how old the polled state may be for single device inclusion reports to be served from it.
+const inclusionCacheMaxAge = 5 * time.Minute
+
+// lockPinConfigPrefix is the prefix of the manifest configs holding the pin of a single smart lock.
+const lockPinConfigPrefix = "lock_pin_"
+
 type FromFimpRouter struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
 	inboundMsgCh fimpgo.MessageCh
 	mqt          *fimpgo.MqttTransport
 	instanceId   string
@@ -21,10 +38,17 @@ type FromFimpRouter struct {
 	configs      *model.Configs
 	client       *verisure.Client
 	states       *model.States
+	keeper       *verisure.SessionKeeper
+	loginKey     *model.LoginKey
+	// lockConfirmTimeout bounds the wait for a smart lock to report the result of a lock or unlock.
+	lockConfirmTimeout time.Duration
+	// pendingPassword is the password of a login waiting for a verification code.
+	pendingPassword string
 }
 
-func NewFromFimpRouter(mqt *fimpgo.MqttTransport, appLifecycle *edgeapp.Lifecycle, configs *model.Configs, client *verisure.Client, states *model.States) *FromFimpRouter {
-	fc := FromFimpRouter{inboundMsgCh: make(fimpgo.MessageCh, 5), mqt: mqt, appLifecycle: appLifecycle, configs: configs, client: client, states: states}
+func NewFromFimpRouter(mqt *fimpgo.MqttTransport, appLifecycle *edgeapp.Lifecycle, configs *model.Configs, client *verisure.Client, states *model.States, keeper *verisure.SessionKeeper, loginKey *model.LoginKey) *FromFimpRouter {
+	ctx, cancel := context.WithCancel(context.Background())
+	fc := FromFimpRouter{ctx: ctx, cancel: cancel, inboundMsgCh: make(fimpgo.MessageCh, 5), mqt: mqt, appLifecycle: appLifecycle, configs: configs, client: client, states: states, keeper: keeper, loginKey: loginKey, lockConfirmTimeout: defaultLockConfirmTimeout}
 	fc.mqt.RegisterChannel("ch1", fc.inboundMsgCh)
 	return &fc
 }
@@ -45,176 +69,503 @@ func (fc *FromFimpRouter) Start() {
 			select {
 			case newMsg := <-msgChan:
 				fc.routeFimpMessage(newMsg)
+			case <-fc.ctx.Done():
+				return
 			}
 		}
 	}(fc.inboundMsgCh)
 }
 
+// Stop cancels the command in progress and stops routing new messages.
+func (fc *FromFimpRouter) Stop() {
+	fc.cancel()
+}
+
 func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 	log.Debugf("New fimp msg . cmd = %s, %s", newMsg.Payload.Type, newMsg.Payload.Service)
 
-	addr := strings.Replace(newMsg.Addr.ServiceAddress, "_0", "", 1)
+	ctx, cancel := context.WithTimeout(fc.ctx, commandTimeout)
+	defer cancel()
+
 	if fc.configs.Installation != "" {
 		fc.client.SetGIID(fc.configs.Installation)
 	}
-	ns := model.NetworkService{}
+
+	// The states are locked while the message is handled, but unlocked around each call to Verisure, so a slow
+	// call doesn't hold up the poller and the session keeper.
+	fc.states.Lock()
+	defer fc.states.Unlock()
+
+	deviceLabel := fc.states.GetDeviceLabel(newMsg.Addr.ServiceAddress)
+	ns := model.NetworkService{Addresses: fc.states.Addresses}
 	switch newMsg.Payload.Service {
 	case "door_lock":
-		addr = strings.Replace(addr, "l", "", 1)
 		switch newMsg.Payload.Type {
 		case "cmd.lock.set":
-			lockPin := fmt.Sprintf("%d", fc.configs.LockPin)
-			if lockPin == "" || lockPin == "0" {
-				log.Error("missing lock pin")
+			var isLocking bool
+			var pin string
+			if newMsg.Payload.ValueType == fimpgo.VTypeObject {
+				lockCmd := model.LockCommand{}
+				if err := newMsg.Payload.GetObjectValue(&lockCmd); err != nil {
+					log.Error("Incorrect lock message")
+					fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "incorrect lock message")
+					return
+				}
+				isLocking = lockCmd.IsSecured
+				pin = lockCmd.Pin
+			} else {
+				var err error
+				isLocking, err = newMsg.Payload.GetBoolValue()
+				if err != nil {
+					log.Error(err)
+					fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "incorrect lock message")
+					return
+				}
+				pin = newMsg.Payload.Properties["pin"]
+			}
+
+			smartLock := fc.states.GetSmartLockByDeviceLabel(deviceLabel)
+			if smartLock == nil {
+				log.Error("Unknown smart lock ", newMsg.Addr.ServiceAddress)
+				fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "unknown smart lock "+newMsg.Addr.ServiceAddress)
 				return
 			}
 
-			isLocking, err := newMsg.Payload.GetBoolValue()
+			lockPin, err := fc.getLockPin(pin, smartLock.Device.DeviceLabel)
 			if err != nil {
 				log.Error(err)
+				fc.appLifecycle.SetLastError(err.Error())
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidPin, err.Error())
+				return
 			}
 
-			smartLock := fc.states.GetSmartLockByDeviceLabel(addr)
-			if smartLock != nil {
-				deviceId := strings.ReplaceAll(smartLock.Device.DeviceLabel, " ", "")
-				stateVal := &model.LockState{}
-				trueVal := true
-				falseVal := false
-				if isLocking {
-					log.Debug("Locking")
-					err := fc.client.LockSmartLock(smartLock.Device.DeviceLabel, lockPin)
-					if err != nil {
-						log.Error(err)
-						// TODO: Handle error response
-						return
-					}
-					stateVal.IsSecured = &trueVal
-				} else {
-					log.Debug("Unlocking")
-					err := fc.client.UnlockSmartLock(smartLock.Device.DeviceLabel, lockPin)
-					if err != nil {
-						log.Error(err)
-						// TODO: Handle error response
-						return
-					}
-					stateVal.IsSecured = &falseVal
+			deviceId := fc.states.GetAddress(smartLock.Device.DeviceLabel)
+			want := model.LockStatusUnlocked
+			setLock := fc.client.UnlockSmartLockContext
+			if isLocking {
+				log.Debug("Locking")
+				want = model.LockStatusLocked
+				setLock = fc.client.LockSmartLockContext
+			} else {
+				log.Debug("Unlocking")
+			}
+
+			// The lock may have been operated since the last poll, so the event time to wait past is read right
+			// before the lock or unlock is sent.
+			fc.states.Unlock()
+			locks, err := fc.client.FetchSmartLockContext(ctx)
+			if fc.handleClientError(ctx, err) {
+				locks, err = fc.client.FetchSmartLockContext(ctx)
+			}
+			fc.states.Lock()
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
+			}
+			previous := smartLock.EventTime
+			for _, l := range locks {
+				if l.Device.DeviceLabel == smartLock.Device.DeviceLabel {
+					previous = l.EventTime
 				}
+			}
+
+			fc.states.Unlock()
+			err = setLock(ctx, smartLock.Device.DeviceLabel, lockPin)
+			if fc.handleClientError(ctx, err) {
+				err = setLock(ctx, smartLock.Device.DeviceLabel, lockPin)
+			}
+			fc.states.Lock()
+			var lock *model.SmartLockDevice
+			if err == nil {
+				waitCtx, waitCancel := context.WithTimeout(ctx, fc.lockConfirmTimeout)
+				fc.states.Unlock()
+				lock, err = fc.client.WaitForLockStateContext(waitCtx, smartLock.Device.DeviceLabel, want, previous)
+				fc.states.Lock()
+				waitCancel()
+			}
+
+			if lock != nil {
+				props := lock.GetReportProps()
 
 				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "door_lock", ServiceAddress: deviceId}
-				msg := fimpgo.NewMessage("evt.lock.report", "door_lock", fimpgo.VTypeBoolMap, stateVal, nil, nil, nil)
+				msg := fimpgo.NewMessage("evt.lock.report", "door_lock", fimpgo.VTypeBoolMap, lock.GetLockState(), props, nil, newMsg.Payload)
 				fc.mqt.Publish(adr, msg)
+
+				for i := range fc.states.SmartLocks {
+					if fc.states.SmartLocks[i].Device.DeviceLabel == lock.Device.DeviceLabel {
+						fc.states.SmartLocks[i] = *lock
+					}
+				}
+				fc.states.SaveToFile()
+			}
+
+			if err != nil {
+				log.Error(err)
+				if errors.Is(err, verisure.ErrLockJammed) {
+					fc.appLifecycle.SetLastError("The lock is jammed")
+				}
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
 			}
 		case "cmd.lock.get_report":
-			smartLock := fc.states.GetSmartLockByDeviceLabel(addr)
-			locks, err := fc.client.FetchSmartLock()
+			smartLock := fc.states.GetSmartLockByDeviceLabel(deviceLabel)
+			fc.states.Unlock()
+			locks, err := fc.client.FetchSmartLockContext(ctx)
+			if fc.handleClientError(ctx, err) {
+				locks, err = fc.client.FetchSmartLockContext(ctx)
+			}
+			fc.states.Lock()
 			if err != nil {
 				log.Error(err)
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
 			}
-			if len(locks) > 0 {
-				for _, l := range locks {
-					if l.Device.DeviceLabel == smartLock.Device.DeviceLabel {
-						if smartLock.EventTime == l.EventTime {
-							break
-						}
-						deviceId := strings.ReplaceAll(l.Device.DeviceLabel, " ", "")
-						stateVal := &model.LockState{}
-
-						trueVal := true
-						falseVal := false
-						if l.LockStatus == "LOCKED" {
-							stateVal.IsSecured = &trueVal
-						} else {
-							stateVal.IsSecured = &falseVal
-						}
-
-						props := fimpgo.Props{}
-						if l.LockMethod == "CODE" {
-							props["lock_type"] = "PIN"
-						} else {
-							props["lock_type"] = "KEY"
-						}
-
-						adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "door_lock", ServiceAddress: deviceId}
-						msg := fimpgo.NewMessage("evt.lock.report", "door_lock", fimpgo.VTypeBoolMap, stateVal, props, nil, nil)
-						fc.mqt.Publish(adr, msg)
-						break
-					}
+			found := false
+			for _, l := range locks {
+				deviceId := fc.states.GetAddress(l.Device.DeviceLabel)
+				if deviceId != newMsg.Addr.ServiceAddress {
+					continue
+				}
+				found = true
+				if smartLock != nil && smartLock.EventTime == l.EventTime && smartLock.DoorState == l.DoorState {
+					break
 				}
-				fc.states.SmartLocks = locks
+				stateVal := l.GetLockState()
+				props := l.GetReportProps()
+
+				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "door_lock", ServiceAddress: deviceId}
+				msg := fimpgo.NewMessage("evt.lock.report", "door_lock", fimpgo.VTypeBoolMap, stateVal, props, nil, nil)
+				fc.mqt.Publish(adr, msg)
+				break
+			}
+			if len(locks) > 0 {
+				fetched := &model.Installation{SmartLocks: locks}
+				fc.states.RemoveIgnored(fetched)
+				fc.states.SmartLocks = fetched.SmartLocks
 				fc.states.SaveToFile()
 			}
+			if !found {
+				fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "unknown smart lock "+newMsg.Addr.ServiceAddress)
+			}
+		case "cmd.config.set":
+			params, err := newMsg.Payload.GetStrMapValue()
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "incorrect config message")
+				return
+			}
+			config, err := model.NewSmartLockConfiguration(params)
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, err.Error())
+				return
+			}
+
+			smartLock := fc.states.GetSmartLockByDeviceLabel(deviceLabel)
+			if smartLock == nil {
+				log.Error("Unknown smart lock ", newMsg.Addr.ServiceAddress)
+				fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "unknown smart lock "+newMsg.Addr.ServiceAddress)
+				return
+			}
+
+			fc.states.Unlock()
+			err = fc.client.SetSmartLockConfigContext(ctx, smartLock.Device.DeviceLabel, *config)
+			if fc.handleClientError(ctx, err) {
+				err = fc.client.SetSmartLockConfigContext(ctx, smartLock.Device.DeviceLabel, *config)
+			}
+			fc.states.Lock()
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
+			}
+
+			fc.states.Unlock()
+			config, err = fc.client.FetchSmartLockConfigContext(ctx, smartLock.Device.DeviceLabel)
+			fc.states.Lock()
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
+			}
+
+			deviceId := fc.states.GetAddress(smartLock.Device.DeviceLabel)
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "door_lock", ServiceAddress: deviceId}
+			msg := fimpgo.NewMessage("evt.config.report", "door_lock", fimpgo.VTypeStrMap, config.GetFimpValue(), nil, nil, newMsg.Payload)
+			fc.mqt.Publish(adr, msg)
+		case "cmd.config.get_report":
+			smartLock := fc.states.GetSmartLockByDeviceLabel(deviceLabel)
+			if smartLock == nil {
+				log.Error("Unknown smart lock ", newMsg.Addr.ServiceAddress)
+				fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "unknown smart lock "+newMsg.Addr.ServiceAddress)
+				return
+			}
+
+			fc.states.Unlock()
+			config, err := fc.client.FetchSmartLockConfigContext(ctx, smartLock.Device.DeviceLabel)
+			if fc.handleClientError(ctx, err) {
+				config, err = fc.client.FetchSmartLockConfigContext(ctx, smartLock.Device.DeviceLabel)
+			}
+			fc.states.Lock()
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
+			}
+
+			deviceId := fc.states.GetAddress(smartLock.Device.DeviceLabel)
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "door_lock", ServiceAddress: deviceId}
+			msg := fimpgo.NewMessage("evt.config.report", "door_lock", fimpgo.VTypeStrMap, config.GetFimpValue(), nil, nil, newMsg.Payload)
+			fc.mqt.Publish(adr, msg)
 		}
 	case "sensor_temp":
-		addr = strings.Replace(addr, "l", "", 1)
 		switch newMsg.Payload.Type {
 		case "cmd.sensor.get_report":
-			bk := fc.states.GetClimateByDeviceLabel(addr)
-			climates, err := fc.client.FetchClimate()
+			bk := fc.states.GetClimateByDeviceLabel(deviceLabel)
+			fc.states.Unlock()
+			climates, err := fc.client.FetchClimateContext(ctx)
+			if fc.handleClientError(ctx, err) {
+				climates, err = fc.client.FetchClimateContext(ctx)
+			}
+			fc.states.Lock()
 			if err != nil {
 				log.Error(err)
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
 			}
-			if len(climates) > 0 {
-				for _, climate := range climates {
-					if bk.Device.DeviceLabel == climate.Device.DeviceLabel {
-						if bk != nil && climate.TemperatureTimestamp == bk.TemperatureTimestamp {
-							break
-						}
-						deviceId := strings.ReplaceAll(climate.Device.DeviceLabel, " ", "")
-						tempVal := climate.TemperatureValue
-						props := fimpgo.Props{}
-						props["unit"] = "C"
-
-						adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_temp", ServiceAddress: deviceId}
-						msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, tempVal, props, nil, nil)
-						fc.mqt.Publish(adr, msg)
-
-						if climate.HumidityEnabled {
-							humidityVal := climate.HumidityValue
-							props := fimpgo.Props{}
-							props["unit"] = "%"
-
-							adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_humid", ServiceAddress: deviceId}
-							msg := fimpgo.NewMessage("evt.sensor.report", "sensor_humid", fimpgo.VTypeFloat, humidityVal, props, nil, nil)
-							fc.mqt.Publish(adr, msg)
-						}
-						break
-					}
+			found := false
+			for _, climate := range climates {
+				deviceId := fc.states.GetAddress(climate.Device.DeviceLabel)
+				if deviceId != newMsg.Addr.ServiceAddress {
+					continue
 				}
-				fc.states.Climates = climates
+				found = true
+				if bk != nil && climate.TemperatureTimestamp == bk.TemperatureTimestamp {
+					break
+				}
+				tempVal := climate.TemperatureValue
+				props := fimpgo.Props{}
+				props["unit"] = "C"
+
+				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_temp", ServiceAddress: deviceId}
+				msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, tempVal, props, nil, nil)
+				fc.mqt.Publish(adr, msg)
+
+				if climate.HumidityEnabled {
+					humidityVal := climate.HumidityValue
+					props := fimpgo.Props{}
+					props["unit"] = "%"
+
+					adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_humid", ServiceAddress: deviceId}
+					msg := fimpgo.NewMessage("evt.sensor.report", "sensor_humid", fimpgo.VTypeFloat, humidityVal, props, nil, nil)
+					fc.mqt.Publish(adr, msg)
+				}
+				break
+			}
+			if len(climates) > 0 {
+				fetched := &model.Installation{Climates: climates}
+				fc.states.RemoveIgnored(fetched)
+				fc.states.Climates = fetched.Climates
 				fc.states.SaveToFile()
 			}
+			if !found {
+				fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "unknown climate sensor "+newMsg.Addr.ServiceAddress)
+			}
 		}
 
 	case "sensor_contact":
-		addr = strings.Replace(addr, "l", "", 1)
 		switch newMsg.Payload.Type {
 		case "cmd.open.get_report":
-			bk := fc.states.GetDoorWindowByDeviceLabel(addr)
-			doorsAndWindows, err := fc.client.FetchDoorWindow()
+			bk := fc.states.GetDoorWindowByDeviceLabel(deviceLabel)
+			fc.states.Unlock()
+			doorsAndWindows, err := fc.client.FetchDoorWindowContext(ctx)
+			if fc.handleClientError(ctx, err) {
+				doorsAndWindows, err = fc.client.FetchDoorWindowContext(ctx)
+			}
+			fc.states.Lock()
 			if err != nil {
 				log.Error(err)
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
+			}
+			found := false
+			for _, daw := range doorsAndWindows {
+				deviceId := fc.states.GetAddress(daw.Device.DeviceLabel)
+				if deviceId != newMsg.Addr.ServiceAddress {
+					continue
+				}
+				found = true
+				if bk != nil && daw.ReportTime == bk.ReportTime {
+					break
+				}
+				stateVal := false
+				if daw.State == "OPEN" {
+					stateVal = true
+				}
+
+				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_contact", ServiceAddress: deviceId}
+				msg := fimpgo.NewMessage("evt.open.report", "sensor_contact", fimpgo.VTypeBool, stateVal, nil, nil, nil)
+				fc.mqt.Publish(adr, msg)
+				break
 			}
 			if len(doorsAndWindows) > 0 {
-				for _, daw := range doorsAndWindows {
-					if bk.Device.DeviceLabel == daw.Device.DeviceLabel {
-						if bk != nil && daw.ReportTime == bk.ReportTime {
-							break
-						}
-						deviceId := strings.ReplaceAll(daw.Device.DeviceLabel, " ", "")
-						stateVal := false
-						if daw.State == "OPEN" {
-							stateVal = true
-						}
-
-						adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_contact", ServiceAddress: deviceId}
-						msg := fimpgo.NewMessage("evt.open.report", "sensor_contact", fimpgo.VTypeBool, stateVal, nil, nil, nil)
-						fc.mqt.Publish(adr, msg)
-						break
-					}
+				fetched := &model.Installation{DoorWindows: doorsAndWindows}
+				fc.states.RemoveIgnored(fetched)
+				fc.states.DoorWindows = fetched.DoorWindows
+				fc.states.SaveToFile()
+			}
+			if !found {
+				fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "unknown door or window sensor "+newMsg.Addr.ServiceAddress)
+			}
+		}
+
+	case "out_bin_switch":
+		switch newMsg.Payload.Type {
+		case "cmd.binary.set":
+			turnOn, err := newMsg.Payload.GetBoolValue()
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "incorrect binary message")
+				return
+			}
+
+			smartPlug := fc.states.GetSmartPlugByDeviceLabel(deviceLabel)
+			if smartPlug == nil {
+				log.Error("Unknown smart plug ", newMsg.Addr.ServiceAddress)
+				fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "unknown smart plug "+newMsg.Addr.ServiceAddress)
+				return
+			}
+			if turnOn && smartPlug.IsHazardous && !fc.configs.AllowHazardousPlugs {
+				log.Error("smart plug is flagged as hazardous and remote switching is not allowed")
+				fc.sendErrorReport(newMsg, model.ErrorCodeNotAllowed, "smart plug is flagged as hazardous and remote switching is not allowed")
+				return
+			}
+
+			setState := fc.client.TurnOffSmartPlugContext
+			if turnOn {
+				setState = fc.client.TurnOnSmartPlugContext
+			}
+			fc.states.Unlock()
+			err = setState(ctx, smartPlug.Device.DeviceLabel)
+			if fc.handleClientError(ctx, err) {
+				err = setState(ctx, smartPlug.Device.DeviceLabel)
+			}
+			fc.states.Lock()
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
+			}
+
+			deviceId := fc.states.GetAddress(smartPlug.Device.DeviceLabel)
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "out_bin_switch", ServiceAddress: deviceId}
+			msg := fimpgo.NewMessage("evt.binary.report", "out_bin_switch", fimpgo.VTypeBool, turnOn, nil, nil, newMsg.Payload)
+			fc.mqt.Publish(adr, msg)
+		case "cmd.binary.get_report":
+			fc.states.Unlock()
+			smartPlugs, err := fc.client.FetchSmartPlugContext(ctx)
+			if fc.handleClientError(ctx, err) {
+				smartPlugs, err = fc.client.FetchSmartPlugContext(ctx)
+			}
+			fc.states.Lock()
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
+			}
+			found := false
+			for _, sp := range smartPlugs {
+				deviceId := fc.states.GetAddress(sp.Device.DeviceLabel)
+				if deviceId == newMsg.Addr.ServiceAddress {
+					found = true
+					adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "out_bin_switch", ServiceAddress: deviceId}
+					msg := fimpgo.NewMessage("evt.binary.report", "out_bin_switch", fimpgo.VTypeBool, sp.IsOn(), nil, nil, newMsg.Payload)
+					fc.mqt.Publish(adr, msg)
+					break
 				}
-				fc.states.DoorWindows = doorsAndWindows
+			}
+			if len(smartPlugs) > 0 {
+				fetched := &model.Installation{SmartPlugs: smartPlugs}
+				fc.states.RemoveIgnored(fetched)
+				fc.states.SmartPlugs = fetched.SmartPlugs
 				fc.states.SaveToFile()
 			}
+			if !found {
+				fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "unknown smart plug "+newMsg.Addr.ServiceAddress)
+			}
+		}
+
+	case "alarm_panel":
+		if newMsg.Addr.ServiceAddress != fc.configs.Installation {
+			log.Error("Unknown alarm panel ", newMsg.Addr.ServiceAddress)
+			fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "unknown alarm panel "+newMsg.Addr.ServiceAddress)
+			return
+		}
+		switch newMsg.Payload.Type {
+		case "cmd.arm.set":
+			armPin, err := fc.getArmPin(newMsg.Payload.Properties["pin"])
+			if err != nil {
+				log.Error(err)
+				fc.appLifecycle.SetLastError(err.Error())
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidPin, err.Error())
+				return
+			}
+
+			mode, err := newMsg.Payload.GetStringValue()
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "incorrect arm message")
+				return
+			}
+
+			var setArmState func(ctx context.Context, code string) error
+			switch mode {
+			case model.FimpArmStates[model.ArmStateArmedAway]:
+				setArmState = fc.client.ArmAwayContext
+			case model.FimpArmStates[model.ArmStateArmedHome]:
+				setArmState = fc.client.ArmHomeContext
+			case model.FimpArmStates[model.ArmStateDisarmed]:
+				setArmState = fc.client.DisarmContext
+			default:
+				log.Error("unknown arm mode ", mode)
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "unknown arm mode "+mode)
+				return
+			}
+			fc.states.Unlock()
+			err = setArmState(ctx, armPin)
+			if fc.handleClientError(ctx, err) {
+				err = setArmState(ctx, armPin)
+			}
+			fc.states.Lock()
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
+			}
+
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "alarm_panel", ServiceAddress: newMsg.Addr.ServiceAddress}
+			msg := fimpgo.NewMessage("evt.arm.report", "alarm_panel", fimpgo.VTypeString, mode, nil, nil, newMsg.Payload)
+			fc.mqt.Publish(adr, msg)
+		case "cmd.arm.get_report":
+			fc.states.Unlock()
+			armState, err := fc.client.FetchArmStateContext(ctx)
+			if fc.handleClientError(ctx, err) {
+				armState, err = fc.client.FetchArmStateContext(ctx)
+			}
+			fc.states.Lock()
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
+			}
+
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "alarm_panel", ServiceAddress: newMsg.Addr.ServiceAddress}
+			msg := fimpgo.NewMessage("evt.arm.report", "alarm_panel", fimpgo.VTypeString, armState.GetFimpValue(), armState.GetReportProps(), nil, newMsg.Payload)
+			fc.mqt.Publish(adr, msg)
+
+			fc.states.ArmState = armState
+			fc.states.SaveToFile()
 		}
 
 	case model.ServiceName:
@@ -225,6 +576,7 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 			err := newMsg.Payload.GetObjectValue(&authReq)
 			if err != nil {
 				log.Error("Incorrect login message ")
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "incorrect login message")
 				return
 			}
 			status := model.AuthStatus{
@@ -232,19 +584,59 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 				ErrorText: "",
 				ErrorCode: "",
 			}
-			if authReq.Username != "" && authReq.Password != "" {
+			if authReq.Encrypted && authReq.Password != "" {
+				authReq.Password, err = fc.loginKey.Decrypt(authReq.Password)
+				if err != nil {
+					log.Error("Failed to decrypt login: ", err)
+					status.Status = "ERROR"
+					status.ErrorText = "The password could not be decrypted"
+					status.ErrorCode = model.AuthErrorCodeDecryptionFailed
+				}
+			} else if !authReq.Encrypted && fc.configs.RequireEncryptedLogin {
+				log.Error("Plain text login rejected")
+				status.Status = "ERROR"
+				status.ErrorText = "The password must be encrypted"
+				status.ErrorCode = model.AuthErrorCodeEncryptionRequired
+			}
+			if status.ErrorCode != "" {
+				fc.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+			} else if authReq.Username != "" && authReq.Password != "" {
 				fc.appLifecycle.SetAuthState(edgeapp.AuthStateInProgress)
 
 				fc.states.ClearState()
 
-				err = fc.client.Login(authReq.Username, authReq.Password)
-				if err != nil {
+				fc.states.Unlock()
+				err = fc.client.LoginContext(ctx, authReq.Username, authReq.Password)
+				fc.states.Lock()
+				fc.pendingPassword = ""
+				if err == nil && fc.configs.RememberLogin {
+					fc.states.Password = authReq.Password
+					fc.states.SaveToFile()
+				}
+				if err == verisure.ErrMFARequired {
+					// The password is only remembered once the code is accepted, so the session keeper
+					// doesn't log in again and drop the login that is waiting for the code.
+					fc.pendingPassword = authReq.Password
+					fc.states.Unlock()
+					err = fc.client.RequestMFACodeContext(ctx, authReq.MFAMethod)
+					fc.states.Lock()
+					if err != nil {
+						log.Error(err)
+						status.Status = "ERROR"
+						status.ErrorText = "Failed to send verification code"
+						fc.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+					} else {
+						status.Status = model.AuthStatusCodeRequired
+						status.ErrorText = "Enter the verification code sent by Verisure"
+					}
+				} else if err != nil {
 					log.Error(err)
 					status.Status = "ERROR"
 					status.ErrorText = "Invalid username or password"
 					fc.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
 				} else {
 					fc.appLifecycle.SetAuthState(edgeapp.AuthStateAuthenticated)
+					fc.keeper.Wake()
 				}
 			} else {
 				status.Status = "ERROR"
@@ -258,11 +650,55 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 				fc.mqt.Publish(adr, msg)
 			}
 
+		case "cmd.auth.set_code":
+			codeReq := model.MFACode{}
+			err := newMsg.Payload.GetObjectValue(&codeReq)
+			if err != nil {
+				log.Error("Incorrect verification code message ")
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "incorrect verification code message")
+				return
+			}
+			status := model.AuthStatus{
+				Status:    edgeapp.AuthStateAuthenticated,
+				ErrorText: "",
+				ErrorCode: "",
+			}
+			if codeReq.Code != "" {
+				fc.states.Unlock()
+				err = fc.client.ValidateMFACodeContext(ctx, codeReq.Code)
+				fc.states.Lock()
+				if err != nil {
+					log.Error(err)
+					status.Status = "ERROR"
+					status.ErrorText = "Invalid verification code"
+					fc.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+				} else {
+					if fc.pendingPassword != "" && fc.configs.RememberLogin {
+						fc.states.Password = fc.pendingPassword
+						fc.states.SaveToFile()
+					}
+					fc.pendingPassword = ""
+					fc.appLifecycle.SetAuthState(edgeapp.AuthStateAuthenticated)
+					fc.keeper.Wake()
+				}
+			} else {
+				status.Status = "ERROR"
+				status.ErrorText = "Empty verification code"
+				fc.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+			}
+
+			msg := fimpgo.NewMessage("evt.auth.status_report", model.ServiceName, fimpgo.VTypeObject, status, nil, nil, newMsg.Payload)
+			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
+				// if response topic is not set , sending back to default application event topic
+				fc.mqt.Publish(adr, msg)
+			}
+
 		case "cmd.auth.set_tokens":
 			authReq := model.SetTokens{}
 			err := newMsg.Payload.GetObjectValue(&authReq)
 			if err != nil {
-				log.Error("Incorrect login message ")
+				log.Error("Incorrect set tokens message ")
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "incorrect set tokens message")
 				return
 			}
 			status := model.AuthStatus{
@@ -270,41 +706,150 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 				ErrorText: "",
 				ErrorCode: "",
 			}
-			if authReq.AccessToken != "" && authReq.RefreshToken != "" {
-				// TODO: This is an example . Add your logic here or remove
+			if authReq.Encrypted {
+				for _, token := range []*string{&authReq.AccessToken, &authReq.RefreshToken} {
+					if *token == "" {
+						continue
+					}
+					if *token, err = fc.loginKey.Decrypt(*token); err != nil {
+						log.Error("Failed to decrypt tokens: ", err)
+						status.Status = "ERROR"
+						status.ErrorText = "The tokens could not be decrypted"
+						status.ErrorCode = model.AuthErrorCodeDecryptionFailed
+						break
+					}
+				}
+			} else if fc.configs.RequireEncryptedLogin {
+				log.Error("Plain text tokens rejected")
+				status.Status = "ERROR"
+				status.ErrorText = "The tokens must be encrypted"
+				status.ErrorCode = model.AuthErrorCodeEncryptionRequired
+			}
+			if status.ErrorCode != "" {
+				fc.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+			} else if authReq.Username != "" && authReq.AccessToken != "" && authReq.RefreshToken != "" {
+				fc.appLifecycle.SetAuthState(edgeapp.AuthStateInProgress)
+
+				fc.states.ClearState()
+
+				fc.states.Unlock()
+				err = fc.client.SetTokensContext(ctx, authReq.Username, authReq.AccessToken, authReq.RefreshToken, time.Duration(authReq.ExpiresIn)*time.Second)
+				fc.states.Lock()
+				if err != nil {
+					log.Error("Failed to set tokens: ", err)
+					status.Status = "ERROR"
+					status.ErrorText = "Verisure did not accept the tokens"
+					fc.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+				} else {
+					fc.appLifecycle.SetAuthState(edgeapp.AuthStateAuthenticated)
+					fc.keeper.Wake()
+				}
 			} else {
 				status.Status = "ERROR"
-				status.ErrorText = "Empty username or password"
+				status.ErrorText = "Empty username, access or refresh token"
+				fc.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
 			}
-			fc.appLifecycle.SetAuthState(edgeapp.AuthStateAuthenticated)
+
 			msg := fimpgo.NewMessage("evt.auth.status_report", model.ServiceName, fimpgo.VTypeObject, status, nil, nil, newMsg.Payload)
 			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
 				// if response topic is not set , sending back to default application event topic
 				fc.mqt.Publish(adr, msg)
 			}
 
+		case "cmd.auth.logout":
+			status := model.AuthStatus{
+				Status:    edgeapp.AuthStateNotAuthenticated,
+				ErrorText: "",
+				ErrorCode: "",
+			}
+			fc.states.Unlock()
+			if err := fc.client.LogoutContext(ctx); err != nil {
+				log.Error("Failed to log out from Verisure: ", err)
+				status.ErrorText = "Logged out, but Verisure could not end the session"
+			}
+			fc.states.Lock()
+
+			addresses := fc.states.GetThingAddresses()
+			if fc.configs.Installation != "" {
+				addresses = append(addresses, fc.configs.Installation)
+			}
+			for _, address := range addresses {
+				val := map[string]interface{}{
+					"address": address,
+				}
+				msg := fimpgo.NewMessage("evt.thing.exclusion_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, nil)
+				fc.mqt.Publish(adr, msg)
+			}
+
+			fc.states.ClearAddresses()
+			fc.states.ClearState()
+			fc.pendingPassword = ""
+			fc.configs.Installation = ""
+			fc.configs.SaveToFile()
+			fc.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+			fc.appLifecycle.SetConfigState(edgeapp.ConfigStateNotConfigured)
+			fc.appLifecycle.SetConnectionState(edgeapp.ConnStateDisconnected)
+			log.Info("Logged out, ", len(addresses), " devices excluded")
+
+			msg := fimpgo.NewMessage("evt.auth.status_report", model.ServiceName, fimpgo.VTypeObject, status, nil, nil, newMsg.Payload)
+			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
+				fc.mqt.Publish(adr, msg)
+			}
+
+		case "cmd.auth.get_login_key":
+			msg := fimpgo.NewMessage("evt.auth.login_key_report", model.ServiceName, fimpgo.VTypeString, fc.loginKey.PublicKeyPEM(), nil, nil, newMsg.Payload)
+			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
+				fc.mqt.Publish(adr, msg)
+			}
+
+		case "cmd.auth.get_session_report":
+			msg := fimpgo.NewMessage("evt.auth.session_report", model.ServiceName, fimpgo.VTypeObject, fc.keeper.Status(), nil, nil, newMsg.Payload)
+			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
+				fc.mqt.Publish(adr, msg)
+			}
+
 		case "cmd.app.get_manifest":
 			mode, err := newMsg.Payload.GetStringValue()
 			if err != nil {
 				log.Error("Incorrect request format ")
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "incorrect request format")
 				return
 			}
 			manifest := edgeapp.NewManifest()
 			err = manifest.LoadFromFile(filepath.Join(fc.configs.GetDefaultDir(), "app-manifest.json"))
 			if err != nil {
 				log.Error("Failed to load manifest file .Error :", err.Error())
+				fc.sendErrorReport(newMsg, model.ErrorCodeCommandFailed, "failed to load manifest")
 				return
 			}
 			if mode == "manifest_state" {
 				manifest.AppState = *fc.appLifecycle.GetAllStates()
-				manifest.ConfigState = fc.configs
+				manifest.ConfigState = fc.configs.Redacted()
+			}
+			if block := manifest.GetUIBlock("lock_pin_block"); block != nil {
+				for _, smartLock := range fc.states.SmartLocks {
+					id := lockPinConfigPrefix + fc.states.GetAddress(smartLock.Device.DeviceLabel)
+					manifest.Configs = append(manifest.Configs, edgeapp.AppConfig{
+						ID:          id,
+						Label:       edgeapp.MultilingualLabel{"en": fmt.Sprintf("Pin for %s %s (leave empty to keep the current pin)", smartLock.Device.Gui.Label, smartLock.Device.Area)},
+						ValT:        "string",
+						UI:          edgeapp.AppConfigUI{Type: "input_string"},
+						Val:         edgeapp.Value{Default: ""},
+						ConfigPoint: "any",
+					})
+					block.Configs = append(block.Configs, id)
+				}
 			}
 			accessCookie := fc.states.GetCookieByName("vs-access")
 			if accessCookie != nil && accessCookie.Expires.After(time.Now()) {
-				fc.appLifecycle.SetAuthState(edgeapp.AuthStateAuthenticated)
+				if fc.appLifecycle.AuthState() != model.AuthStateExpiring {
+					fc.appLifecycle.SetAuthState(edgeapp.AuthStateAuthenticated)
+				}
 				fc.appLifecycle.SetConnectionState(edgeapp.ConnStateConnected)
 
-				installations, err := fc.client.FetchAllInstallations()
+				fc.states.Unlock()
+				installations, err := fc.client.FetchAllInstallationsContext(ctx)
+				fc.states.Lock()
 				if err != nil {
 					log.Error(err)
 				}
@@ -352,7 +897,7 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 
 		case "cmd.config.get_extended_report":
 
-			msg := fimpgo.NewMessage("evt.config.extended_report", model.ServiceName, fimpgo.VTypeObject, fc.configs, nil, nil, newMsg.Payload)
+			msg := fimpgo.NewMessage("evt.config.extended_report", model.ServiceName, fimpgo.VTypeObject, fc.configs.Redacted(), nil, nil, newMsg.Payload)
 			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
 				fc.mqt.Publish(adr, msg)
 			}
@@ -361,76 +906,100 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 			conf := model.Configs{}
 			err := newMsg.Payload.GetObjectValue(&conf)
 			if err != nil {
-				// TODO: This is an example . Add your logic here or remove
 				log.Error("Can't parse configuration object")
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "can't parse configuration object")
 				return
 			}
-			fc.configs.Installation = conf.Installation
-
-			fc.client.SetGIID(conf.Installation)
 
-			fc.configs.LockPin = conf.LockPin
-			fc.configs.SaveToFile()
-			log.Debugf("App reconfigured . New parameters : %v", fc.configs)
-			// TODO: This is an example . Add your logic here or remove
-
-			if conf.Installation != "" {
-				fc.client.UpdateToken()
-				climates, err := fc.client.FetchClimate()
-				if err != nil {
-					log.Error(err)
+			pinLength := 0
+			if installation := fc.states.GetInstallationByGIID(conf.Installation); installation != nil {
+				pinLength = installation.PinCodeLength
+			}
+			if conf.LockPin != "" {
+				if err := model.ValidatePin(string(conf.LockPin), pinLength); err != nil {
+					fc.sendErrorReport(newMsg, model.ErrorCodeInvalidPin, "lock_pin: "+err.Error())
+					return
 				}
-				for _, climate := range climates {
-					inclReport := ns.SendClimateInclusionReport(climate)
-					if err != nil {
-						log.Error(err)
-					}
-
-					msg2 := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, nil)
-					adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
-					fc.mqt.Publish(&adr, msg2)
+			}
+			if conf.AlarmPin != "" {
+				if err := model.ValidatePin(string(conf.AlarmPin), pinLength); err != nil {
+					fc.sendErrorReport(newMsg, model.ErrorCodeInvalidPin, "alarm_pin: "+err.Error())
+					return
 				}
-
-				doorsAndWindows, err := fc.client.FetchDoorWindow()
-				if err != nil {
-					log.Error(err)
+			}
+			lockPins := map[string]string{}
+			params := map[string]interface{}{}
+			if err := newMsg.Payload.GetObjectValue(&params); err == nil {
+				for key, val := range params {
+					if !strings.HasPrefix(key, lockPinConfigPrefix) {
+						continue
+					}
+					smartLock := fc.states.GetSmartLockByDeviceLabel(fc.states.GetDeviceLabel(strings.TrimPrefix(key, lockPinConfigPrefix)))
+					if smartLock == nil {
+						continue
+					}
+					pin, _ := val.(string)
+					if pin == "" {
+						continue
+					}
+					if err := model.ValidatePin(pin, pinLength); err != nil {
+						fc.sendErrorReport(newMsg, model.ErrorCodeInvalidPin, key+": "+err.Error())
+						return
+					}
+					lockPins[smartLock.Device.DeviceLabel] = pin
 				}
+			}
 
-				for _, doorsAndWindow := range doorsAndWindows {
-					inclReport := ns.SendDoorWindowInclusionReport(doorsAndWindow)
-					if err != nil {
-						log.Error(err)
-					}
+			fc.configs.Installation = conf.Installation
 
-					msg2 := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, nil)
-					adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
-					fc.mqt.Publish(&adr, msg2)
-				}
+			fc.states.Unlock()
+			fc.client.SetGIID(conf.Installation)
+			fc.states.Lock()
 
-				smartLocks, err := fc.client.FetchSmartLock()
-				if err != nil {
-					log.Error(err)
-				}
+			// Pins are never sent to the UI, so an empty pin keeps the stored one.
+			if conf.LockPin != "" {
+				fc.configs.LockPin = conf.LockPin
+			}
+			for deviceLabel, pin := range lockPins {
+				fc.configs.SetLockPin(deviceLabel, pin)
+			}
+			if conf.AlarmPin != "" {
+				fc.configs.AlarmPin = conf.AlarmPin
+			}
+			fc.configs.AllowHazardousPlugs = conf.AllowHazardousPlugs
+			fc.configs.RequireEncryptedLogin = conf.RequireEncryptedLogin
+			fc.configs.RememberLogin = conf.RememberLogin
+			fc.configs.AutoInclusion = conf.AutoInclusion
+			if !conf.RememberLogin && fc.states.Password != "" {
+				fc.states.Password = ""
+				fc.states.SaveToFile()
+			}
+			switch conf.PinPolicy {
+			case model.PinPolicyStored, model.PinPolicyOnDemand, model.PinPolicyBoth:
+				fc.configs.SetPinPolicy(conf.Installation, conf.PinPolicy)
+			default:
+				fc.configs.PinPolicy = fc.configs.GetPinPolicy(conf.Installation)
+			}
+			fc.configs.SaveToFile()
+			log.Debugf("App reconfigured . Installation : %s", fc.configs.Installation)
 
-				for _, smartLock := range smartLocks {
-					inclReport := ns.SendSmartLockInclusionReport(smartLock)
-					if err != nil {
-						log.Error(err)
-					}
+			configReport := model.ConfigReport{
+				OpStatus: "ok",
+			}
 
-					msg2 := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, nil)
-					adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
-					fc.mqt.Publish(&adr, msg2)
-				}
+			if conf.Installation != "" {
+				fetchErr := fc.sendInclusionReports(ctx, conf.Installation)
 
 				fc.appLifecycle.SetAppState(edgeapp.AppStateRunning, nil)
 				fc.appLifecycle.SetConfigState(edgeapp.ConfigStateConfigured)
-			}
 
-			configReport := model.ConfigReport{
-				OpStatus: "ok",
-				AppState: *fc.appLifecycle.GetAllStates(),
+				if fetchErr != nil {
+					configReport.OpStatus = "error"
+					fc.sendErrorReport(newMsg, errorCode(fetchErr), fetchErr.Error())
+				}
 			}
+
+			configReport.AppState = *fc.appLifecycle.GetAllStates()
 			msg := fimpgo.NewMessage("evt.app.config_report", model.ServiceName, fimpgo.VTypeObject, configReport, nil, nil, newMsg.Payload)
 			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
 				log.Error(err)
@@ -441,14 +1010,17 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 			// Configure log level
 			level, err := newMsg.Payload.GetStringValue()
 			if err != nil {
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "incorrect log level message")
 				return
 			}
 			logLevel, err := log.ParseLevel(level)
-			if err == nil {
-				log.SetLevel(logLevel)
-				fc.configs.LogLevel = level
-				fc.configs.SaveToFile()
+			if err != nil {
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, err.Error())
+				return
 			}
+			log.SetLevel(logLevel)
+			fc.configs.LogLevel = level
+			fc.configs.SaveToFile()
 			log.Info("Log level updated to = ", logLevel)
 
 		case "cmd.system.reconnect":
@@ -467,6 +1039,8 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 			}
 
 		case "cmd.app.factory_reset":
+			fc.states.Trust = nil
+			fc.states.ClearAddresses()
 			fc.states.ClearState()
 			val := edgeapp.ButtonActionResponse{
 				Operation:       "cmd.app.factory_reset",
@@ -486,54 +1060,46 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 			// TODO: The message is sent to the app from fhbutler before performing package uninstall operation
 
 		case "cmd.network.get_all_nodes":
-			// TODO: This is an example . Add your logic here or remove
-		case "cmd.thing.get_inclusion_report":
-			fc.client.UpdateToken()
-			climates, err := fc.client.FetchClimate()
-			if err != nil {
-				log.Error(err)
-			}
-			for _, climate := range climates {
-				inclReport := ns.SendClimateInclusionReport(climate)
-				if err != nil {
-					log.Error(err)
-				}
-
-				msg2 := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, nil)
-				adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
-				fc.mqt.Publish(&adr, msg2)
-			}
-
-			doorsAndWindows, err := fc.client.FetchDoorWindow()
-			if err != nil {
-				log.Error(err)
+			nodes := ns.GetAllNodes(fc.states, fc.configs.Installation)
+			msg := fimpgo.NewMessage("evt.network.all_nodes_report", model.ServiceName, fimpgo.VTypeObject, nodes, nil, nil, newMsg.Payload)
+			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
+				fc.mqt.Publish(adr, msg)
 			}
 
-			for _, doorsAndWindow := range doorsAndWindows {
-				inclReport := ns.SendDoorWindowInclusionReport(doorsAndWindow)
-				if err != nil {
-					log.Error(err)
+		case "cmd.thing.get_inclusion_report":
+			// Only the device with the address in the value is reported, unless the all property is true.
+			if newMsg.Payload.Properties["all"] != "true" {
+				address, _ := newMsg.Payload.GetStringValue()
+				if address == "" {
+					fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "address is required, or set the all property to true")
+					return
+				}
+				if fc.states.IsIgnored(address) {
+					fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "device "+address+" is ignored")
+					return
 				}
 
-				msg2 := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, nil)
-				adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
-				fc.mqt.Publish(&adr, msg2)
-			}
-
-			smartLocks, err := fc.client.FetchSmartLock()
-			if err != nil {
-				log.Error(err)
-			}
+				cached := &model.Installation{Climates: fc.states.Climates, DoorWindows: fc.states.DoorWindows, SmartLocks: fc.states.SmartLocks, SmartPlugs: fc.states.SmartPlugs}
+				if fc.states.IsFresh(inclusionCacheMaxAge) && fc.sendInclusionReport(cached, address, newMsg.Payload) {
+					return
+				}
 
-			for _, smartLock := range smartLocks {
-				inclReport := ns.SendSmartLockInclusionReport(smartLock)
+				fc.states.Unlock()
+				installationState, err := fc.client.FetchInstallationStateContext(ctx)
+				fc.states.Lock()
 				if err != nil {
 					log.Error(err)
+					fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+					return
+				}
+				if !fc.sendInclusionReport(installationState, address, newMsg.Payload) {
+					fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "unknown device "+address)
 				}
+				return
+			}
 
-				msg2 := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, nil)
-				adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
-				fc.mqt.Publish(&adr, msg2)
+			if fetchErr := fc.sendInclusionReports(ctx, fc.configs.Installation); fetchErr != nil {
+				fc.sendErrorReport(newMsg, errorCode(fetchErr), fetchErr.Error())
 			}
 
 		case "cmd.thing.inclusion":
@@ -544,23 +1110,277 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 			val, err := newMsg.Payload.GetStrMapValue()
 			if err != nil {
 				log.Error("Wrong msg format")
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "wrong message format")
 				return
 			}
 			deviceID, ok := val["address"]
-			if ok {
+			if ok && deviceID != "" {
+				fc.states.IgnoreDevice(deviceID)
+				fc.states.SaveToFile()
+
 				val := map[string]interface{}{
 					"address": deviceID,
 				}
 				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
 				msg := fimpgo.NewMessage("evt.thing.exclusion_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
 				fc.mqt.Publish(adr, msg)
-				log.Info("Device with deviceID: ", deviceID, " has been removed from network.")
+				log.Info("Device with deviceID: ", deviceID, " has been removed from network and is ignored.")
 			} else {
 				log.Error("Incorrect address")
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "incorrect address")
+			}
 
+		case "cmd.thing.get_ignored_report":
+			ignored := append([]string{}, fc.states.IgnoredDevices...)
+			msg := fimpgo.NewMessage("evt.thing.ignored_report", model.ServiceName, fimpgo.VTypeStrArray, ignored, nil, nil, newMsg.Payload)
+			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
+				fc.mqt.Publish(adr, msg)
+			}
+
+		case "cmd.thing.include_ignored":
+			val, err := newMsg.Payload.GetStrMapValue()
+			if err != nil {
+				log.Error("Wrong msg format")
+				fc.sendErrorReport(newMsg, model.ErrorCodeInvalidRequest, "wrong message format")
+				return
+			}
+			deviceID := val["address"]
+			if !fc.states.IncludeDevice(deviceID) {
+				fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "device "+deviceID+" is not ignored")
+				return
+			}
+			fc.states.SaveToFile()
+			log.Info("Device with deviceID: ", deviceID, " is no longer ignored.")
+
+			fc.states.Unlock()
+			installationState, err := fc.client.FetchInstallationStateContext(ctx)
+			fc.states.Lock()
+			if err != nil {
+				log.Error(err)
+				fc.sendErrorReport(newMsg, errorCode(err), err.Error())
+				return
+			}
+			if !fc.sendInclusionReport(installationState, deviceID, newMsg.Payload) {
+				fc.sendErrorReport(newMsg, model.ErrorCodeUnknownDevice, "device "+deviceID+" was not found in Verisure")
 			}
 		}
 
 	}
 
 }
+
+// sendInclusionReports fetches the devices of the installation and publishes the inclusion reports of those that are
+// not ignored, with the alarm panel of the installation. It returns the last error of the fetches, after reporting the
+// devices that could be fetched. The states must be locked, and are unlocked while Verisure is called.
+func (fc *FromFimpRouter) sendInclusionReports(ctx context.Context, giid string) error {
+	var fetchErr error
+	fetched := func(err error) {
+		if err != nil {
+			log.Error(err)
+			fetchErr = err
+		}
+	}
+
+	fc.states.Unlock()
+	fetched(fc.client.UpdateTokenContext(ctx))
+	climates, err := fc.client.FetchClimateContext(ctx)
+	fetched(err)
+	doorsAndWindows, err := fc.client.FetchDoorWindowContext(ctx)
+	fetched(err)
+	smartLocks, err := fc.client.FetchSmartLockContext(ctx)
+	fetched(err)
+	smartPlugs, err := fc.client.FetchSmartPlugContext(ctx)
+	fetched(err)
+	armState, err := fc.client.FetchArmStateContext(ctx)
+	fetched(err)
+	fc.states.Lock()
+
+	ns := model.NetworkService{Addresses: fc.states.Addresses}
+	var reports []fimptype.ThingInclusionReport
+	for _, climate := range climates {
+		if !fc.states.IsIgnored(fc.states.GetAddress(climate.Device.DeviceLabel)) {
+			reports = append(reports, ns.SendClimateInclusionReport(climate))
+		}
+	}
+	for _, doorWindow := range doorsAndWindows {
+		if !fc.states.IsIgnored(fc.states.GetAddress(doorWindow.Device.DeviceLabel)) {
+			reports = append(reports, ns.SendDoorWindowInclusionReport(doorWindow))
+		}
+	}
+	for _, smartLock := range smartLocks {
+		if !fc.states.IsIgnored(fc.states.GetAddress(smartLock.Device.DeviceLabel)) {
+			reports = append(reports, ns.SendSmartLockInclusionReport(smartLock))
+		}
+	}
+	for _, smartPlug := range smartPlugs {
+		if !fc.states.IsIgnored(fc.states.GetAddress(smartPlug.Device.DeviceLabel)) {
+			reports = append(reports, ns.SendSmartPlugInclusionReport(smartPlug))
+		}
+	}
+	if armState != nil && giid != "" && !fc.states.IsIgnored(giid) {
+		installation := fc.states.GetInstallationByGIID(giid)
+		if installation == nil {
+			installation = &model.Installation{Giid: giid}
+		}
+		reports = append(reports, ns.SendAlarmInclusionReport(*installation))
+	}
+
+	adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+	for _, report := range reports {
+		msg := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, report, nil, nil, nil)
+		fc.mqt.Publish(&adr, msg)
+	}
+	return fetchErr
+}
+
+// sendInclusionReport publishes the inclusion report of the device with the address, looked up in the installation
+// state. The alarm panel has the address of the installation. It returns false if the device was not found.
+func (fc *FromFimpRouter) sendInclusionReport(installationState *model.Installation, address string, reqMsg *fimpgo.FimpMessage) bool {
+	ns := model.NetworkService{Addresses: fc.states.Addresses}
+	var inclReport *fimptype.ThingInclusionReport
+	for _, climate := range installationState.Climates {
+		if fc.states.GetAddress(climate.Device.DeviceLabel) == address {
+			report := ns.SendClimateInclusionReport(climate)
+			inclReport = &report
+		}
+	}
+	for _, doorWindow := range installationState.DoorWindows {
+		if fc.states.GetAddress(doorWindow.Device.DeviceLabel) == address {
+			report := ns.SendDoorWindowInclusionReport(doorWindow)
+			inclReport = &report
+		}
+	}
+	for _, smartLock := range installationState.SmartLocks {
+		if fc.states.GetAddress(smartLock.Device.DeviceLabel) == address {
+			report := ns.SendSmartLockInclusionReport(smartLock)
+			inclReport = &report
+		}
+	}
+	for _, smartPlug := range installationState.SmartPlugs {
+		if fc.states.GetAddress(smartPlug.Device.DeviceLabel) == address {
+			report := ns.SendSmartPlugInclusionReport(smartPlug)
+			inclReport = &report
+		}
+	}
+	if address == fc.configs.Installation {
+		installation := fc.states.GetInstallationByGIID(fc.configs.Installation)
+		if installation == nil {
+			installation = &model.Installation{Giid: fc.configs.Installation}
+		}
+		report := ns.SendAlarmInclusionReport(*installation)
+		inclReport = &report
+	}
+	if inclReport == nil {
+		return false
+	}
+
+	msg := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, reqMsg)
+	adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+	fc.mqt.Publish(&adr, msg)
+	return true
+}
+
+// getLockPin returns the pin to use for a lock command, following the pin policy of the installation.
+// The pin supplied with the command takes precedence over the stored one. The pin must never be logged.
+func (fc *FromFimpRouter) getLockPin(pin string, deviceLabel string) (string, error) {
+	return fc.getPin(pin, fc.configs.GetLockPin(deviceLabel))
+}
+
+// getArmPin returns the pin to use for arming or disarming the alarm, following the same pin policy as the locks.
+// The alarm has its own stored code, so without one the pin must be sent with the command.
+func (fc *FromFimpRouter) getArmPin(pin string) (string, error) {
+	return fc.getPin(pin, string(fc.configs.AlarmPin))
+}
+
+func (fc *FromFimpRouter) getPin(pin string, storedPin string) (string, error) {
+	policy := fc.configs.GetPinPolicy(fc.configs.Installation)
+	if pin != "" {
+		if policy == model.PinPolicyStored {
+			return "", errors.New("pin on demand is not allowed for this installation")
+		}
+		if err := model.ValidatePin(pin, fc.pinCodeLength()); err != nil {
+			return "", err
+		}
+		return pin, nil
+	}
+
+	if policy == model.PinPolicyOnDemand {
+		return "", errors.New("pin is required for this installation")
+	}
+	if storedPin == "" {
+		return "", errors.New("missing pin")
+	}
+	return storedPin, nil
+}
+
+// pinCodeLength returns the pin length of the configured installation, or 0 if it is not known.
+func (fc *FromFimpRouter) pinCodeLength() int {
+	installation := fc.states.GetInstallationByGIID(fc.configs.Installation)
+	if installation == nil {
+		return 0
+	}
+	return installation.PinCodeLength
+}
+
+// sendErrorReport publishes evt.error.report for a failed command, as a response to the request if it has a
+// response topic and otherwise on the event topic of the service the command was sent to.
+func (fc *FromFimpRouter) sendErrorReport(newMsg *fimpgo.Message, code string, text string) {
+	props := fimpgo.Props{}
+	props["code"] = code
+	msg := fimpgo.NewMessage("evt.error.report", newMsg.Payload.Service, fimpgo.VTypeString, text, props, nil, newMsg.Payload)
+	if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
+		adr := *newMsg.Addr
+		adr.MsgType = fimpgo.MsgTypeEvt
+		fc.mqt.Publish(&adr, msg)
+	}
+}
+
+// errorCode returns the evt.error.report code for an error returned by the Verisure client.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, verisure.ErrWrongPin):
+		return model.ErrorCodeWrongPin
+	case errors.Is(err, verisure.ErrLockBusy):
+		return model.ErrorCodeLockBusy
+	case errors.Is(err, verisure.ErrLockJammed):
+		return model.ErrorCodeLockJammed
+	case errors.Is(err, verisure.ErrLockTimeout), errors.Is(err, context.DeadlineExceeded):
+		return model.ErrorCodeTimeout
+	case errors.Is(err, verisure.ErrSessionExpired):
+		return model.ErrorCodeSessionExpired
+	case errors.Is(err, verisure.ErrRateLimited):
+		return model.ErrorCodeRateLimited
+	case errors.Is(err, verisure.ErrInstallationNotFound):
+		return model.ErrorCodeInstallationNotFound
+	}
+	return model.ErrorCodeCommandFailed
+}
+
+// handleClientError reacts to the kind of error returned by the Verisure client.
+// It returns true if the session was renewed and the call should be retried once.
+func (fc *FromFimpRouter) handleClientError(ctx context.Context, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, verisure.ErrSessionExpired):
+		log.Info("Verisure session expired, refreshing")
+		if err := fc.client.RefreshTokenContext(ctx); err != nil {
+			log.Error(err)
+			fc.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+			fc.appLifecycle.SetConnectionState(edgeapp.ConnStateDisconnected)
+			fc.appLifecycle.SetLastError("Verisure session expired, log in again")
+			return false
+		}
+		return true
+	case errors.Is(err, verisure.ErrWrongPin):
+		fc.appLifecycle.SetLastError("Wrong pin code")
+	case errors.Is(err, verisure.ErrLockBusy):
+		fc.appLifecycle.SetLastError("The lock is busy, try again")
+	case errors.Is(err, verisure.ErrRateLimited):
+		fc.appLifecycle.SetLastError("Too many requests to Verisure, try again later")
+	case errors.Is(err, verisure.ErrInstallationNotFound):
+		fc.appLifecycle.SetLastError("Installation not found, choose another installation")
+		fc.appLifecycle.SetConfigState(edgeapp.ConfigStateNotConfigured)
+	}
+	return false
+}
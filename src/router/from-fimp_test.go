@@ -0,0 +1,766 @@
+package router
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/futurehomeno/fimpgo"
+	"github.com/futurehomeno/fimpgo/edgeapp"
+	"github.com/futurehomeno/fimpgo/fimptype"
+	"github.com/thingsplex/verisure/model"
+	"github.com/thingsplex/verisure/verisure"
+	"github.com/thingsplex/verisure/verisure/fake"
+)
+
+const (
+	testGIID     = "123456789000"
+	testUsername = "user@example.com"
+	testPassword = "password"
+	testPin      = "123456"
+	testLock     = "CDEF GHIJ"
+	testPlug     = "DEFG HIJK"
+)
+
+// recordingClient is an MQTT client that keeps the published messages instead of sending them to a broker.
+type recordingClient struct {
+	MQTT.Client
+
+	mu       sync.Mutex
+	messages []*fimpgo.Message
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+
+func (rc *recordingClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	addr, _ := fimpgo.NewAddressFromString(topic)
+	msg, _ := fimpgo.NewMessageFromBytes(payload.([]byte))
+	rc.messages = append(rc.messages, &fimpgo.Message{Topic: topic, Addr: addr, Payload: msg})
+	return doneToken{}
+}
+
+// take returns the messages of the given type published since the last call, and forgets all published messages.
+func (rc *recordingClient) take(msgType string) []*fimpgo.Message {
+	return ofType(rc.takeAll(), msgType)
+}
+
+// takeAll returns the messages published since the last call, and forgets them.
+func (rc *recordingClient) takeAll() []*fimpgo.Message {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	taken := rc.messages
+	rc.messages = nil
+	return taken
+}
+
+// ofType returns the messages of the given type.
+func ofType(msgs []*fimpgo.Message, msgType string) []*fimpgo.Message {
+	var found []*fimpgo.Message
+	for _, msg := range msgs {
+		if msg.Payload.Type == msgType {
+			found = append(found, msg)
+		}
+	}
+	return found
+}
+
+type testEnv struct {
+	router   *FromFimpRouter
+	poller   *Poller
+	server   *fake.Server
+	client   *verisure.Client
+	keeper   *verisure.SessionKeeper
+	configs  *model.Configs
+	states   *model.States
+	mqtt     *recordingClient
+	loginKey *model.LoginKey
+}
+
+// newTestEnv sets up a router and a poller for the installation of the fixture, logged in to a fake server.
+func newTestEnv(t *testing.T) *testEnv {
+	workDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(workDir, "data"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"state.json", "config.json"} {
+		if err := ioutil.WriteFile(filepath.Join(workDir, "data", name), []byte("{}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configs := model.NewConfigs(workDir)
+	if err := configs.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	configs.Installation = testGIID
+	configs.LockPin = testPin
+	states := model.NewStates(workDir)
+	if err := states.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	fixture, err := fake.LoadFixture("../verisure/fake/testdata/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fake.NewServer(fixture)
+	server.LockDelay = 0
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	client, err := verisure.NewClient(states, verisure.WithBaseURLs(httpServer.URL), verisure.WithLockPollInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Login(testUsername, testPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &recordingClient{}
+	mqt := fimpgo.NewMqttTransportFromConnection(recorder, 1, 1)
+	loginKey, err := model.NewLoginKey(filepath.Join(workDir, "data", "login-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appLifecycle := edgeapp.NewAppLifecycle()
+	keeper := verisure.NewSessionKeeper(client, appLifecycle)
+	env := &testEnv{
+		router:   NewFromFimpRouter(mqt, appLifecycle, configs, client, states, keeper, loginKey),
+		poller:   NewPoller(mqt, appLifecycle, configs, client, states, keeper, time.Minute),
+		server:   server,
+		client:   client,
+		keeper:   keeper,
+		configs:  configs,
+		states:   states,
+		mqtt:     recorder,
+		loginKey: loginKey,
+	}
+	t.Cleanup(env.router.Stop)
+	return env
+}
+
+// send routes a command to a service of a device, as if it came from Futurehome.
+func (env *testEnv) send(service string, deviceLabel string, msg *fimpgo.FimpMessage) {
+	env.sendToAddress(service, env.states.GetAddress(deviceLabel), msg)
+}
+
+func (env *testEnv) sendToAddress(service string, address string, msg *fimpgo.FimpMessage) {
+	addr := &fimpgo.Address{MsgType: fimpgo.MsgTypeCmd, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: service, ServiceAddress: address}
+	env.route(addr, msg)
+}
+
+// sendToApp routes a command to the app itself.
+func (env *testEnv) sendToApp(msg *fimpgo.FimpMessage) {
+	addr := &fimpgo.Address{MsgType: fimpgo.MsgTypeCmd, ResourceType: fimpgo.ResourceTypeApp, ResourceName: model.ServiceName, ResourceAddress: "1"}
+	env.route(addr, msg)
+}
+
+// route serializes the message like the MQTT transport does, so object values are decoded as they would be.
+func (env *testEnv) route(addr *fimpgo.Address, msg *fimpgo.FimpMessage) {
+	body, err := msg.SerializeToJson()
+	if err != nil {
+		panic(err)
+	}
+	payload, err := fimpgo.NewMessageFromBytes(body)
+	if err != nil {
+		panic(err)
+	}
+	env.router.routeFimpMessage(&fimpgo.Message{Addr: addr, Payload: payload})
+}
+
+// inclusionReports decodes inclusion reports by device address.
+func inclusionReports(t *testing.T, msgs []*fimpgo.Message) map[string]fimptype.ThingInclusionReport {
+	t.Helper()
+	reports := map[string]fimptype.ThingInclusionReport{}
+	for _, msg := range msgs {
+		report := fimptype.ThingInclusionReport{}
+		if err := msg.Payload.GetObjectValue(&report); err != nil {
+			t.Fatal(err)
+		}
+		reports[report.Address] = report
+	}
+	return reports
+}
+
+// checkInclusionReport compares the alias and the product name, which holds the area, with the fixture.
+func checkInclusionReport(t *testing.T, report fimptype.ThingInclusionReport, wantAlias string, wantProductName string) {
+	t.Helper()
+	if report.Alias != wantAlias || report.ProductName != wantProductName {
+		t.Errorf("got alias %q and product name %q, want %q and %q", report.Alias, report.ProductName, wantAlias, wantProductName)
+	}
+}
+
+func TestSmartPlugSet(t *testing.T) {
+	env := newTestEnv(t)
+	env.poller.Poll(env.router.ctx)
+	env.mqtt.take("")
+
+	env.send("out_bin_switch", testPlug, fimpgo.NewBoolMessage("cmd.binary.set", "out_bin_switch", true, nil, nil, nil))
+
+	reports := env.mqtt.take("evt.binary.report")
+	if len(reports) != 1 {
+		t.Fatalf("got %d binary reports, want 1", len(reports))
+	}
+	if on, _ := reports[0].Payload.GetBoolValue(); !on {
+		t.Error("binary report is off, want on")
+	}
+	if state := env.server.Installation(testGIID).SmartPlugs[0].CurrentState; state != "ON" {
+		t.Errorf("plug is %s, want ON", state)
+	}
+}
+
+func TestUnknownDevice(t *testing.T) {
+	env := newTestEnv(t)
+	env.poller.Poll(env.router.ctx)
+	env.mqtt.take("")
+
+	env.send("out_bin_switch", "not a device", fimpgo.NewBoolMessage("cmd.binary.set", "out_bin_switch", true, nil, nil, nil))
+
+	reports := env.mqtt.take("evt.error.report")
+	if len(reports) != 1 || reports[0].Payload.Properties["code"] != model.ErrorCodeUnknownDevice {
+		t.Fatalf("got %v, want an %s error report", reports, model.ErrorCodeUnknownDevice)
+	}
+}
+
+func TestSmartLockSet(t *testing.T) {
+	env := newTestEnv(t)
+	env.poller.Poll(env.router.ctx)
+	env.mqtt.take("")
+
+	env.send("door_lock", testLock, fimpgo.NewBoolMessage("cmd.lock.set", "door_lock", false, nil, nil, nil))
+
+	if errors := env.mqtt.take("evt.error.report"); len(errors) != 0 {
+		t.Fatalf("got error report %v", errors[0].Payload.Value)
+	}
+	if status := env.server.Installation(testGIID).SmartLocks[0].LockStatus; status != model.LockStatusUnlocked {
+		t.Errorf("lock is %s, want %s", status, model.LockStatusUnlocked)
+	}
+}
+
+func TestSmartLockSetAfterLockOperatedSincePoll(t *testing.T) {
+	env := newTestEnv(t)
+	env.server.StatusDelay = 50 * time.Millisecond
+	env.poller.Poll(env.router.ctx)
+	env.mqtt.take("")
+
+	// Unlocked at the door after the poll, and still reported unlocked for a while after the lock is sent.
+	env.server.OperateLock(testLock, model.LockStatusUnlocked)
+	env.send("door_lock", testLock, fimpgo.NewBoolMessage("cmd.lock.set", "door_lock", true, nil, nil, nil))
+
+	if errors := env.mqtt.take("evt.error.report"); len(errors) != 0 {
+		t.Fatalf("got error report %v", errors[0].Payload.Value)
+	}
+	if status := env.server.Installation(testGIID).SmartLocks[0].LockStatus; status != model.LockStatusLocked {
+		t.Errorf("lock is %s, want %s", status, model.LockStatusLocked)
+	}
+}
+
+func TestSmartLockSetFailures(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(env *testEnv)
+		code  string
+		// status is the lock_status of the final lock report, or empty if there is none.
+		status string
+	}{
+		{
+			name:   "jammed",
+			setup:  func(env *testEnv) { env.server.JamLock(testLock) },
+			code:   model.ErrorCodeLockJammed,
+			status: "jammed",
+		},
+		{
+			name:  "busy",
+			setup: func(env *testEnv) { env.server.BusyLock(testLock) },
+			code:  model.ErrorCodeLockBusy,
+		},
+		{
+			name:  "operation rejected",
+			setup: func(env *testEnv) { env.server.RejectLock(testLock) },
+			code:  model.ErrorCodeLockBusy,
+		},
+		{
+			name: "no confirmation",
+			setup: func(env *testEnv) {
+				env.server.LockDelay = time.Minute
+				env.router.lockConfirmTimeout = 100 * time.Millisecond
+			},
+			code:   model.ErrorCodeTimeout,
+			status: "pending",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.poller.Poll(env.router.ctx)
+			env.mqtt.take("")
+			tt.setup(env)
+
+			env.send("door_lock", testLock, fimpgo.NewBoolMessage("cmd.lock.set", "door_lock", false, nil, nil, nil))
+
+			msgs := env.mqtt.takeAll()
+			errors := ofType(msgs, "evt.error.report")
+			if len(errors) != 1 || errors[0].Payload.Properties["code"] != tt.code {
+				t.Fatalf("got error reports %v, want one with code %s", errors, tt.code)
+			}
+			reports := ofType(msgs, "evt.lock.report")
+			switch {
+			case tt.status == "" && len(reports) != 0:
+				t.Errorf("got lock report %v, want none", reports[0].Payload.Properties)
+			case tt.status != "" && len(reports) != 1:
+				t.Fatalf("got %d lock reports, want 1", len(reports))
+			case tt.status != "" && reports[0].Payload.Properties["lock_status"] != tt.status:
+				t.Errorf("lock reported %s, want %s", reports[0].Payload.Properties["lock_status"], tt.status)
+			}
+			if tt.status == "" && env.states.SmartLocks[0].LockStatus != model.LockStatusLocked {
+				t.Errorf("cached lock is %s after a failed unlock, want %s", env.states.SmartLocks[0].LockStatus, model.LockStatusLocked)
+			}
+		})
+	}
+}
+
+func TestLogoutForgetsAddresses(t *testing.T) {
+	env := newTestEnv(t)
+	env.poller.Poll(env.router.ctx)
+	plug := env.states.GetAddress(testPlug)
+	env.states.IgnoreDevice(plug)
+	env.mqtt.take("")
+
+	env.sendToApp(fimpgo.NewNullMessage("cmd.auth.logout", model.ServiceName, nil, nil, nil))
+
+	if reports := env.mqtt.take("evt.thing.exclusion_report"); len(reports) == 0 {
+		t.Fatal("no devices excluded on logout")
+	}
+	if !env.states.Addresses.IsEmpty() || env.states.IsIgnored(plug) {
+		t.Error("addresses and ignored devices kept after logout")
+	}
+}
+
+func TestArmSetPinPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		alarmPin  model.PinCode
+		pin       string
+		wantArmed bool
+	}{
+		{"stored pin", model.PinPolicyStored, testPin, "", true},
+		{"no stored alarm code", model.PinPolicyStored, "", "", false},
+		{"pin on demand not allowed", model.PinPolicyStored, testPin, testPin, false},
+		{"pin on demand", model.PinPolicyOnDemand, testPin, testPin, true},
+		{"pin on demand missing", model.PinPolicyOnDemand, testPin, "", false},
+		{"wrong pin on demand", model.PinPolicyBoth, testPin, "000000", false},
+		{"stored pin when both are allowed", model.PinPolicyBoth, testPin, "", true},
+		{"pin on demand without a stored alarm code", model.PinPolicyBoth, "", testPin, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.configs.SetPinPolicy(testGIID, tt.policy)
+			// The lock pin is stored in every case, and must not be used for the alarm.
+			env.configs.AlarmPin = tt.alarmPin
+			props := fimpgo.Props{}
+			if tt.pin != "" {
+				props["pin"] = tt.pin
+			}
+
+			mode := model.FimpArmStates[model.ArmStateArmedAway]
+			env.sendToAddress("alarm_panel", testGIID, fimpgo.NewStringMessage("cmd.arm.set", "alarm_panel", mode, props, nil, nil))
+
+			errors := env.mqtt.take("evt.error.report")
+			armed := env.server.Installation(testGIID).ArmState.StatusType == model.ArmStateArmedAway
+			if armed != tt.wantArmed || (len(errors) == 0) != tt.wantArmed {
+				t.Errorf("armed: %t with %d error reports, want armed: %t", armed, len(errors), tt.wantArmed)
+			}
+		})
+	}
+}
+
+func TestGetInclusionReport(t *testing.T) {
+	tests := []struct {
+		name  string
+		poll  bool
+		props fimpgo.Props
+	}{
+		{"from the polled state", true, nil},
+		{"fetched without a fresh poll", false, nil},
+		{"all devices", false, fimpgo.Props{"all": "true"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			if tt.poll {
+				env.poller.Poll(env.router.ctx)
+			}
+			env.mqtt.take("")
+			operations := len(env.server.Operations())
+
+			address := env.states.GetAddress(testLock)
+			env.sendToApp(fimpgo.NewStringMessage("cmd.thing.get_inclusion_report", model.ServiceName, address, tt.props, nil, nil))
+
+			report, ok := inclusionReports(t, env.mqtt.take("evt.thing.inclusion_report"))[address]
+			if !ok {
+				t.Fatal("no inclusion report for the lock")
+			}
+			checkInclusionReport(t, report, "verisure Smart lock", "Smart lock Front door")
+			if fetched := len(env.server.Operations()) > operations; fetched == tt.poll {
+				t.Errorf("fetched from Verisure: %t, want %t", fetched, !tt.poll)
+			}
+		})
+	}
+}
+
+func TestGetAllNodes(t *testing.T) {
+	env := newTestEnv(t)
+	env.poller.Poll(env.router.ctx)
+	env.mqtt.take("")
+
+	env.sendToApp(fimpgo.NewNullMessage("cmd.network.get_all_nodes", model.ServiceName, nil, nil, nil))
+
+	reports := env.mqtt.take("evt.network.all_nodes_report")
+	if len(reports) != 1 {
+		t.Fatalf("got %d all nodes reports, want 1", len(reports))
+	}
+	var nodes []model.NetworkNode
+	if err := reports[0].Payload.GetObjectValue(&nodes); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]model.NetworkNode{
+		"ABCD EFGH": {Area: "Living room", GuiType: "Smoke detector"},
+		"BCDE FGHI": {Area: "Hallway", GuiType: "Door"},
+		testLock:    {Area: "Front door", GuiType: "Smart lock"},
+		testPlug:    {Area: "Kitchen", GuiType: "Smart plug"},
+		testGIID:    {GuiType: "ALARM"},
+	}
+	if len(nodes) != len(want) {
+		t.Errorf("got %d nodes, want %d", len(nodes), len(want))
+	}
+	for _, node := range nodes {
+		w, ok := want[node.DeviceLabel]
+		if !ok {
+			t.Errorf("unexpected node %s", node.DeviceLabel)
+			continue
+		}
+		if node.Area != w.Area || node.GuiType != w.GuiType {
+			t.Errorf("node %s has area %q and GUI type %q, want %q and %q", node.DeviceLabel, node.Area, node.GuiType, w.Area, w.GuiType)
+		}
+		if node.Address != env.states.GetAddress(node.DeviceLabel) && node.DeviceLabel != testGIID {
+			t.Errorf("node %s has address %s", node.DeviceLabel, node.Address)
+		}
+	}
+}
+
+func TestDeletedDeviceStaysOutAfterGetReport(t *testing.T) {
+	env := newTestEnv(t)
+	env.poller.Poll(env.router.ctx)
+	lock := env.states.GetAddress(testLock)
+	env.sendToApp(fimpgo.NewStrMapMessage("cmd.thing.delete", model.ServiceName, map[string]string{"address": lock}, nil, nil, nil))
+	env.send("door_lock", testLock, fimpgo.NewNullMessage("cmd.lock.get_report", "door_lock", nil, nil, nil))
+	env.mqtt.take("")
+
+	env.sendToApp(fimpgo.NewNullMessage("cmd.network.get_all_nodes", model.ServiceName, nil, nil, nil))
+
+	reports := env.mqtt.take("evt.network.all_nodes_report")
+	if len(reports) != 1 {
+		t.Fatalf("got %d all nodes reports, want 1", len(reports))
+	}
+	var nodes []model.NetworkNode
+	if err := reports[0].Payload.GetObjectValue(&nodes); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if node.Address == lock {
+			t.Error("deleted lock is listed again after a lock report")
+		}
+	}
+	if env.states.GetSmartLockByDeviceLabel(testLock) != nil {
+		t.Error("deleted lock is cached again after a lock report")
+	}
+}
+
+func TestLockReportAfterThumbLatch(t *testing.T) {
+	env := newTestEnv(t)
+	env.poller.Poll(env.router.ctx)
+	env.mqtt.take("")
+
+	env.server.OperateLock(testLock, model.LockStatusUnlocked)
+	env.send("door_lock", testLock, fimpgo.NewNullMessage("cmd.lock.get_report", "door_lock", nil, nil, nil))
+
+	reports := env.mqtt.take("evt.lock.report")
+	if len(reports) != 1 {
+		t.Fatalf("got %d lock reports, want 1", len(reports))
+	}
+	if method := reports[0].Payload.Properties["lock_method"]; method != "thumb_turn" {
+		t.Errorf("lock method is %s, want thumb_turn", method)
+	}
+}
+
+// encryptForApp encrypts a value for the login key of the app, the way a client of cmd.auth.login does.
+func encryptForApp(t *testing.T, loginKey *model.LoginKey, plain string) string {
+	block, _ := pem.Decode([]byte(loginKey.PublicKeyPEM()))
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := key.(*ecdsa.PublicKey)
+	ephemeral, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedX, _ := public.Curve.ScalarMult(public.X, public.Y, ephemeral.D.Bytes())
+	shared := make([]byte, 32)
+	sharedX.FillBytes(shared)
+	aesKey := sha256.Sum256(shared)
+	cipherBlock, err := aes.NewCipher(aesKey[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(cipherBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	data := append(elliptic.Marshal(elliptic.P256(), ephemeral.X, ephemeral.Y), nonce...)
+	return base64.StdEncoding.EncodeToString(aead.Seal(data, nonce, []byte(plain), nil))
+}
+
+// authStatus returns the status of the last evt.auth.status_report.
+func authStatus(t *testing.T, env *testEnv) model.AuthStatus {
+	t.Helper()
+	reports := env.mqtt.take("evt.auth.status_report")
+	if len(reports) == 0 {
+		t.Fatal("no auth status report")
+	}
+	status := model.AuthStatus{}
+	if err := reports[len(reports)-1].Payload.GetObjectValue(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestLoginEncryption(t *testing.T) {
+	tests := []struct {
+		name      string
+		required  bool
+		encrypted bool
+		password  func(env *testEnv) string
+		wantCode  string
+	}{
+		{
+			name:      "encrypted",
+			encrypted: true,
+			password:  func(env *testEnv) string { return encryptForApp(t, env.loginKey, testPassword) },
+		},
+		{
+			name:      "encrypted when required",
+			required:  true,
+			encrypted: true,
+			password:  func(env *testEnv) string { return encryptForApp(t, env.loginKey, testPassword) },
+		},
+		{
+			name:     "plain text",
+			password: func(env *testEnv) string { return testPassword },
+		},
+		{
+			name:     "plain text when encryption is required",
+			required: true,
+			password: func(env *testEnv) string { return testPassword },
+			wantCode: model.AuthErrorCodeEncryptionRequired,
+		},
+		{
+			name:      "not encrypted for the login key",
+			encrypted: true,
+			password:  func(env *testEnv) string { return base64.StdEncoding.EncodeToString([]byte(testPassword)) },
+			wantCode:  model.AuthErrorCodeDecryptionFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.configs.RequireEncryptedLogin = tt.required
+			login := model.Login{Username: testUsername, Password: tt.password(env), Encrypted: tt.encrypted}
+
+			env.sendToApp(fimpgo.NewObjectMessage("cmd.auth.login", model.ServiceName, login, nil, nil, nil))
+
+			status := authStatus(t, env)
+			if status.ErrorCode != tt.wantCode {
+				t.Errorf("got error code %q, want %q", status.ErrorCode, tt.wantCode)
+			}
+			wantState := edgeapp.AuthStateAuthenticated
+			if tt.wantCode != "" {
+				wantState = edgeapp.AuthStateNotAuthenticated
+			}
+			if state := env.router.appLifecycle.AuthState(); string(state) != wantState {
+				t.Errorf("auth state %s, want %s", state, wantState)
+			}
+		})
+	}
+}
+
+func TestLoginWithVerificationCode(t *testing.T) {
+	env := newTestEnv(t)
+	env.configs.RememberLogin = true
+	env.server.RequireMFA("654321")
+	login := model.Login{Username: testUsername, Password: testPassword, MFAMethod: model.MFAMethodSMS}
+
+	env.sendToApp(fimpgo.NewObjectMessage("cmd.auth.login", model.ServiceName, login, nil, nil, nil))
+	if status := authStatus(t, env); status.Status != model.AuthStatusCodeRequired {
+		t.Fatalf("got status %+v, want %s", status, model.AuthStatusCodeRequired)
+	}
+	if env.states.Password != "" {
+		t.Error("password remembered before the verification code was accepted")
+	}
+
+	env.sendToApp(fimpgo.NewObjectMessage("cmd.auth.set_code", model.ServiceName, model.MFACode{Code: "000000"}, nil, nil, nil))
+	if status := authStatus(t, env); status.Status != "ERROR" {
+		t.Fatalf("got status %+v for a wrong code, want ERROR", status)
+	}
+
+	env.sendToApp(fimpgo.NewObjectMessage("cmd.auth.set_code", model.ServiceName, model.MFACode{Code: "654321"}, nil, nil, nil))
+	if status := authStatus(t, env); status.Status != edgeapp.AuthStateAuthenticated {
+		t.Fatalf("got status %+v, want %s", status, edgeapp.AuthStateAuthenticated)
+	}
+	if env.states.Trust == nil || env.states.Password != testPassword {
+		t.Error("trust cookie or password not stored after the verification code")
+	}
+
+	// The stored trust cookie lets the next login skip the code.
+	env.sendToApp(fimpgo.NewObjectMessage("cmd.auth.login", model.ServiceName, login, nil, nil, nil))
+	if status := authStatus(t, env); status.Status != edgeapp.AuthStateAuthenticated {
+		t.Errorf("got status %+v on the next login, want %s", status, edgeapp.AuthStateAuthenticated)
+	}
+}
+
+func TestSetTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		required  bool
+		encrypted bool
+		tokens    func(env *testEnv) (string, string)
+		wantCode  string
+		wantError bool
+		// cleared is set when Verisure rejects the tokens, which clears the session.
+		cleared bool
+	}{
+		{
+			name:   "valid tokens",
+			tokens: func(env *testEnv) (string, string) { return env.server.NewSession() },
+		},
+		{
+			name:      "valid encrypted tokens",
+			required:  true,
+			encrypted: true,
+			tokens: func(env *testEnv) (string, string) {
+				access, refresh := env.server.NewSession()
+				return encryptForApp(t, env.loginKey, access), encryptForApp(t, env.loginKey, refresh)
+			},
+		},
+		{
+			name:      "tokens Verisure doesn't know",
+			tokens:    func(env *testEnv) (string, string) { return "unknown", "unknown" },
+			wantError: true,
+			cleared:   true,
+		},
+		{
+			name:      "empty refresh token",
+			tokens:    func(env *testEnv) (string, string) { access, _ := env.server.NewSession(); return access, "" },
+			wantError: true,
+		},
+		{
+			name:      "tokens not encrypted for the login key",
+			encrypted: true,
+			tokens:    func(env *testEnv) (string, string) { return env.server.NewSession() },
+			wantCode:  model.AuthErrorCodeDecryptionFailed,
+			wantError: true,
+		},
+		{
+			name:      "plain text tokens when encryption is required",
+			required:  true,
+			tokens:    func(env *testEnv) (string, string) { return env.server.NewSession() },
+			wantCode:  model.AuthErrorCodeEncryptionRequired,
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			env.configs.RequireEncryptedLogin = tt.required
+			access, refresh := tt.tokens(env)
+			tokens := model.SetTokens{Username: testUsername, AccessToken: access, RefreshToken: refresh, Encrypted: tt.encrypted}
+
+			env.sendToApp(fimpgo.NewObjectMessage("cmd.auth.set_tokens", model.ServiceName, tokens, nil, nil, nil))
+
+			status := authStatus(t, env)
+			if (status.Status == "ERROR") != tt.wantError || status.ErrorCode != tt.wantCode {
+				t.Fatalf("got status %+v, want error %v with code %q", status, tt.wantError, tt.wantCode)
+			}
+			if tt.wantError {
+				if tt.cleared && !env.states.Session.IsEmpty() {
+					t.Error("session kept after Verisure rejected the tokens")
+				}
+				return
+			}
+			if env.states.Username != testUsername {
+				t.Errorf("username %q after importing the tokens", env.states.Username)
+			}
+			if _, err := env.client.FetchInstallationState(); err != nil {
+				t.Errorf("imported session doesn't work: %v", err)
+			}
+		})
+	}
+}
+
+func TestConfigAlarmPin(t *testing.T) {
+	env := newTestEnv(t)
+	env.poller.Poll(env.router.ctx)
+	config := func(alarmPin string) *fimpgo.FimpMessage {
+		return fimpgo.NewObjectMessage("cmd.config.extended_set", model.ServiceName, map[string]interface{}{"installation": testGIID, "alarm_pin": alarmPin}, nil, nil, nil)
+	}
+
+	const alarmPin = "975310"
+
+	env.sendToApp(config("97531a"))
+	if errors := env.mqtt.take("evt.error.report"); len(errors) != 1 || errors[0].Payload.Properties["code"] != model.ErrorCodeInvalidPin {
+		t.Errorf("got error reports %v for an alarm code with a letter, want %s", errors, model.ErrorCodeInvalidPin)
+	}
+
+	env.sendToApp(config(alarmPin))
+	// Pins are never sent to the UI, so an empty code keeps the stored one.
+	env.sendToApp(config(""))
+	if env.configs.AlarmPin != alarmPin || env.configs.LockPin != testPin {
+		t.Errorf("alarm code %q and lock pin %q after configuring the alarm code", env.configs.AlarmPin, env.configs.LockPin)
+	}
+
+	env.mqtt.take("")
+	env.sendToApp(fimpgo.NewNullMessage("cmd.config.get_extended_report", model.ServiceName, nil, nil, nil))
+	reports := env.mqtt.take("evt.config.extended_report")
+	if len(reports) != 1 {
+		t.Fatalf("got %d config reports, want 1", len(reports))
+	}
+	if body, _ := reports[0].Payload.SerializeToJson(); strings.Contains(string(body), alarmPin) {
+		t.Errorf("config report holds a pin: %s", body)
+	}
+}
@@ -0,0 +1,241 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	"github.com/futurehomeno/fimpgo/edgeapp"
+	"github.com/futurehomeno/fimpgo/fimptype"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/verisure/model"
+	"github.com/thingsplex/verisure/verisure"
+)
+
+// Poller fetches the state of the installation and publishes what changed since the last poll.
+type Poller struct {
+	mqt          *fimpgo.MqttTransport
+	appLifecycle *edgeapp.Lifecycle
+	configs      *model.Configs
+	client       *verisure.Client
+	states       *model.States
+	keeper       *verisure.SessionKeeper
+	interval     time.Duration
+	backoff      time.Duration
+	backoffUntil time.Time
+}
+
+func NewPoller(mqt *fimpgo.MqttTransport, appLifecycle *edgeapp.Lifecycle, configs *model.Configs, client *verisure.Client, states *model.States, keeper *verisure.SessionKeeper, interval time.Duration) *Poller {
+	return &Poller{mqt: mqt, appLifecycle: appLifecycle, configs: configs, client: client, states: states, keeper: keeper, interval: interval, backoff: interval}
+}
+
+// Poll runs a single poll. After the installation was rate limited, polls are skipped for a doubling backoff.
+func (p *Poller) Poll(ctx context.Context) {
+	if p.configs.Installation == "" {
+		log.Debug("No installation is setup")
+		return
+	}
+
+	if time.Now().Before(p.backoffUntil) {
+		log.Debug("Backing off until ", p.backoffUntil.Format(time.RFC3339))
+		return
+	}
+
+	p.client.SetGIID(p.configs.Installation)
+
+	if err := p.client.UpdateTokenContext(ctx); err != nil {
+		log.Error(err)
+		p.appLifecycle.SetConnectionState(edgeapp.ConnStateDisconnected)
+		// The keeper logs in again if the session is lost and the credentials were remembered.
+		p.keeper.Wake()
+		return
+	}
+
+	p.appLifecycle.SetConnectionState(edgeapp.ConnStateConnected)
+
+	installationState, err := p.client.FetchInstallationStateContext(ctx)
+	if errors.Is(err, verisure.ErrSessionExpired) {
+		log.Info("Verisure session expired, refreshing")
+		if err := p.client.RefreshTokenContext(ctx); err != nil {
+			log.Error(err)
+			p.appLifecycle.SetConnectionState(edgeapp.ConnStateDisconnected)
+			return
+		}
+		installationState, err = p.client.FetchInstallationStateContext(ctx)
+	}
+	if err != nil {
+		log.Error(err)
+		switch {
+		case errors.Is(err, verisure.ErrRateLimited):
+			p.backoffUntil = time.Now().Add(p.backoff)
+			if p.backoff < 30*time.Minute {
+				p.backoff *= 2
+			}
+		case errors.Is(err, verisure.ErrInstallationNotFound):
+			p.appLifecycle.SetLastError("Installation not found, choose another installation")
+			p.appLifecycle.SetConfigState(edgeapp.ConfigStateNotConfigured)
+		}
+		return
+	}
+	p.backoff = p.interval
+
+	// The states are only locked once the installation is fetched, so the router isn't held up by a slow poll.
+	p.states.Lock()
+	defer p.states.Unlock()
+
+	if installationState != nil {
+		p.states.RemoveIgnored(installationState)
+		ns := model.NetworkService{Addresses: p.states.Addresses}
+		include := func(inclReport fimptype.ThingInclusionReport) {
+			log.Info("New Verisure device ", inclReport.Address)
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+			msg := fimpgo.NewMessage("evt.thing.inclusion_report", model.ServiceName, fimpgo.VTypeObject, inclReport, nil, nil, nil)
+			p.mqt.Publish(adr, msg)
+		}
+		exclude := func(deviceLabel string) {
+			deviceId := p.states.GetAddress(deviceLabel)
+			log.Info("Verisure device ", deviceId, " is gone")
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+			msg := fimpgo.NewMessage("evt.thing.exclusion_report", model.ServiceName, fimpgo.VTypeObject, map[string]interface{}{"address": deviceId}, nil, nil, nil)
+			p.mqt.Publish(adr, msg)
+		}
+		// Devices are only excluded when their list was in the response, so a list missing
+		// because of a partial error doesn't exclude every device of that kind.
+		fetched := model.States{
+			Climates:    installationState.Climates,
+			DoorWindows: installationState.DoorWindows,
+			SmartLocks:  installationState.SmartLocks,
+			SmartPlugs:  installationState.SmartPlugs,
+		}
+
+		for _, climate := range installationState.Climates {
+			deviceId := p.states.GetAddress(climate.Device.DeviceLabel)
+
+			bk := p.states.GetClimateByDeviceLabel(climate.Device.DeviceLabel)
+			if bk == nil && p.configs.AutoInclusion {
+				include(ns.SendClimateInclusionReport(climate))
+			}
+			if bk != nil && climate.TemperatureTimestamp == bk.TemperatureTimestamp {
+				continue
+			}
+			tempVal := climate.TemperatureValue
+			props := fimpgo.Props{}
+			props["unit"] = "C"
+
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_temp", ServiceAddress: deviceId}
+			msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, tempVal, props, nil, nil)
+			p.mqt.Publish(adr, msg)
+
+			if climate.HumidityEnabled {
+				humidityVal := climate.HumidityValue
+				props := fimpgo.Props{}
+				props["unit"] = "%"
+
+				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_humid", ServiceAddress: deviceId}
+				msg := fimpgo.NewMessage("evt.sensor.report", "sensor_humid", fimpgo.VTypeFloat, humidityVal, props, nil, nil)
+				p.mqt.Publish(adr, msg)
+			}
+		}
+		if p.configs.AutoInclusion && installationState.Climates != nil {
+			for _, climate := range p.states.Climates {
+				if fetched.GetClimateByDeviceLabel(climate.Device.DeviceLabel) == nil {
+					exclude(climate.Device.DeviceLabel)
+				}
+			}
+		}
+		p.states.Climates = installationState.Climates
+
+		for _, daw := range installationState.DoorWindows {
+			deviceId := p.states.GetAddress(daw.Device.DeviceLabel)
+			bk := p.states.GetDoorWindowByDeviceLabel(daw.Device.DeviceLabel)
+			if bk == nil && p.configs.AutoInclusion {
+				include(ns.SendDoorWindowInclusionReport(daw))
+			}
+			if bk != nil && daw.ReportTime == bk.ReportTime {
+				continue
+			}
+
+			stateVal := false
+			if daw.State == "OPEN" {
+				stateVal = true
+			}
+
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_contact", ServiceAddress: deviceId}
+			msg := fimpgo.NewMessage("evt.open.report", "sensor_contact", fimpgo.VTypeBool, stateVal, nil, nil, nil)
+			p.mqt.Publish(adr, msg)
+		}
+
+		if p.configs.AutoInclusion && installationState.DoorWindows != nil {
+			for _, daw := range p.states.DoorWindows {
+				if fetched.GetDoorWindowByDeviceLabel(daw.Device.DeviceLabel) == nil {
+					exclude(daw.Device.DeviceLabel)
+				}
+			}
+		}
+		p.states.DoorWindows = installationState.DoorWindows
+
+		for _, smartLock := range installationState.SmartLocks {
+			deviceId := p.states.GetAddress(smartLock.Device.DeviceLabel)
+			bk := p.states.GetSmartLockByDeviceLabel(smartLock.Device.DeviceLabel)
+			if bk == nil && p.configs.AutoInclusion {
+				include(ns.SendSmartLockInclusionReport(smartLock))
+			}
+			if bk != nil && smartLock.EventTime == bk.EventTime && smartLock.DoorState == bk.DoorState {
+				continue
+			}
+
+			stateVal := smartLock.GetLockState()
+			props := smartLock.GetReportProps()
+
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "door_lock", ServiceAddress: deviceId}
+			msg := fimpgo.NewMessage("evt.lock.report", "door_lock", fimpgo.VTypeBoolMap, stateVal, props, nil, nil)
+			p.mqt.Publish(adr, msg)
+		}
+
+		if p.configs.AutoInclusion && installationState.SmartLocks != nil {
+			for _, smartLock := range p.states.SmartLocks {
+				if fetched.GetSmartLockByDeviceLabel(smartLock.Device.DeviceLabel) == nil {
+					exclude(smartLock.Device.DeviceLabel)
+				}
+			}
+		}
+		p.states.SmartLocks = installationState.SmartLocks
+
+		for _, smartPlug := range installationState.SmartPlugs {
+			deviceId := p.states.GetAddress(smartPlug.Device.DeviceLabel)
+			bk := p.states.GetSmartPlugByDeviceLabel(smartPlug.Device.DeviceLabel)
+			if bk == nil && p.configs.AutoInclusion {
+				include(ns.SendSmartPlugInclusionReport(smartPlug))
+			}
+			if bk != nil && smartPlug.CurrentState == bk.CurrentState {
+				continue
+			}
+
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "out_bin_switch", ServiceAddress: deviceId}
+			msg := fimpgo.NewMessage("evt.binary.report", "out_bin_switch", fimpgo.VTypeBool, smartPlug.IsOn(), nil, nil, nil)
+			p.mqt.Publish(adr, msg)
+		}
+
+		if p.configs.AutoInclusion && installationState.SmartPlugs != nil {
+			for _, smartPlug := range p.states.SmartPlugs {
+				if fetched.GetSmartPlugByDeviceLabel(smartPlug.Device.DeviceLabel) == nil {
+					exclude(smartPlug.Device.DeviceLabel)
+				}
+			}
+		}
+		p.states.SmartPlugs = installationState.SmartPlugs
+
+		if armState := installationState.ArmState; armState != nil && !p.states.IsIgnored(p.configs.Installation) {
+			if p.states.ArmState == nil || armState.Date != p.states.ArmState.Date || armState.StatusType != p.states.ArmState.StatusType {
+				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "alarm_panel", ServiceAddress: p.configs.Installation}
+				msg := fimpgo.NewMessage("evt.arm.report", "alarm_panel", fimpgo.VTypeString, armState.GetFimpValue(), armState.GetReportProps(), nil, nil)
+				p.mqt.Publish(adr, msg)
+			}
+			p.states.ArmState = armState
+		}
+
+		p.states.PolledAt = time.Now()
+		p.states.SaveToFile()
+	}
+}
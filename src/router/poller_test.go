@@ -0,0 +1,118 @@
+package router
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	"github.com/thingsplex/verisure/model"
+)
+
+func TestPollPublishesChanges(t *testing.T) {
+	env := newTestEnv(t)
+
+	env.poller.Poll(env.router.ctx)
+	if reports := env.mqtt.take("evt.sensor.report"); len(reports) != 2 {
+		t.Errorf("got %d sensor reports on the first poll, want temperature and humidity", len(reports))
+	}
+	if env.states.PolledAt.IsZero() || len(env.states.Climates) != 1 {
+		t.Fatal("polled state wasn't stored")
+	}
+
+	env.poller.Poll(env.router.ctx)
+	if reports := env.mqtt.take("evt.sensor.report"); len(reports) != 0 {
+		t.Errorf("got %d sensor reports without changes, want none", len(reports))
+	}
+
+	if err := env.client.ArmHome(testPin); err != nil {
+		t.Fatal(err)
+	}
+	env.poller.Poll(env.router.ctx)
+	reports := env.mqtt.take("evt.arm.report")
+	if len(reports) != 1 || reports[0].Addr.ServiceAddress != testGIID {
+		t.Fatalf("got %d arm reports, want 1 for the installation", len(reports))
+	}
+}
+
+func TestPollAutoInclusion(t *testing.T) {
+	env := newTestEnv(t)
+	env.configs.AutoInclusion = true
+	env.states.IgnoreDevice(env.states.GetAddress(testPlug))
+
+	env.poller.Poll(env.router.ctx)
+	reports := env.mqtt.take("evt.thing.inclusion_report")
+	if len(reports) != 3 {
+		t.Fatalf("got %d inclusion reports, want 3 for the devices that aren't ignored", len(reports))
+	}
+	for _, report := range reports {
+		if report.Payload.Service != model.ServiceName {
+			t.Errorf("inclusion report from service %s", report.Payload.Service)
+		}
+	}
+	climate := inclusionReports(t, reports)[env.states.GetAddress("ABCD EFGH")]
+	checkInclusionReport(t, climate, "verisure Smoke detector", "Smoke detector Living room")
+}
+
+func TestPollWhileHandlingCommands(t *testing.T) {
+	env := newTestEnv(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	env.poller.Poll(ctx)
+	env.keeper.Start(ctx)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			env.poller.Poll(ctx)
+			env.keeper.Wake()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			env.send("out_bin_switch", testPlug, fimpgo.NewBoolMessage("cmd.binary.set", "out_bin_switch", i%2 == 0, nil, nil, nil))
+		}
+	}()
+	wg.Wait()
+
+	if errors := env.mqtt.take("evt.error.report"); len(errors) != 0 {
+		t.Errorf("got error report %v", errors[0].Payload.Value)
+	}
+}
+
+func TestPollDuringSlowLockCommand(t *testing.T) {
+	env := newTestEnv(t)
+	env.server.LockDelay = time.Second
+	env.poller.Poll(env.router.ctx)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		env.send("door_lock", testLock, fimpgo.NewBoolMessage("cmd.lock.set", "door_lock", false, nil, nil, nil))
+	}()
+	for !hasOperation(env.server.Operations(), "DoorUnlock") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The router waits for the lock without holding the states.
+	env.poller.Poll(env.router.ctx)
+	select {
+	case <-done:
+		t.Error("the poll waited for the lock command")
+	default:
+	}
+	<-done
+}
+
+func hasOperation(operations []string, name string) bool {
+	for _, operation := range operations {
+		if operation == name {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
-	"strings"
+	"syscall"
 	"time"
 
 	"github.com/futurehomeno/fimpgo"
@@ -16,24 +20,49 @@ import (
 	"github.com/thingsplex/verisure/verisure"
 )
 
+// pollTimeout bounds a single poll of the installation state, including token refresh and retries.
+const pollTimeout = 45 * time.Second
+
 func main() {
-	var workDir string
+	var workDir, apiURL string
 	flag.StringVar(&workDir, "c", "", "Work dir")
+	flag.StringVar(&apiURL, "u", "", "Verisure API url, e.g. a local verisure-fake server")
 	flag.Parse()
 	if workDir == "" {
 		workDir = "./"
 	} else {
 		fmt.Println("Work dir ", workDir)
 	}
+	rootCtx, shutdown := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Info("Shutting down")
+		shutdown()
+	}()
+
 	appLifecycle := edgeapp.NewAppLifecycle()
 	configs := model.NewConfigs(workDir)
-	err := configs.LoadFromFile()
+	secrets, err := model.NewSecretStore(filepath.Join(configs.GetDataDir(), "secret.key"))
+	if err != nil {
+		fmt.Print(err)
+		panic("Can't load secret key file.")
+	}
+	loginKey, err := model.NewLoginKey(filepath.Join(configs.GetDataDir(), "login-key.pem"))
+	if err != nil {
+		fmt.Print(err)
+		panic("Can't load login key.")
+	}
+	configs.UseSecretStore(secrets)
+	err = configs.LoadFromFile()
 	if err != nil {
 		fmt.Print(err)
 		panic("Can't load config file.")
 	}
 
 	states := model.NewStates(workDir)
+	states.UseSecretStore(secrets)
 	err = states.LoadFromFile()
 	if err != nil {
 		fmt.Print(err)
@@ -44,6 +73,11 @@ func main() {
 	log.Info("--------------Starting verisure----------------")
 	log.Info("Work directory : ", configs.WorkDir)
 
+	if installation := states.GetInstallationByGIID(configs.Installation); installation != nil && configs.MigrateLockPins(installation.PinCodeLength) {
+		log.Info("Restored leading zeros of stored pins")
+		configs.SaveToFile()
+	}
+
 	appLifecycle.SetAppState(edgeapp.AppStateNotConfigured, nil)
 
 	mqtt := fimpgo.NewMqttTransport(configs.MqttServerURI, configs.MqttClientIdPrefix, configs.MqttUsername, configs.MqttPassword, true, 1, 1)
@@ -52,9 +86,16 @@ func main() {
 	responder.RegisterResource(model.GetDiscoveryResource())
 	responder.Start()
 
-	vsureService, _ := verisure.NewClient(states)
+	clientOpts := []verisure.Option{verisure.WithRequestTimeout(30 * time.Second)}
+	if apiURL != "" {
+		clientOpts = append(clientOpts, verisure.WithBaseURLs(apiURL))
+	}
+	vsureService, _ := verisure.NewClient(states, clientOpts...)
+
+	sessionKeeper := verisure.NewSessionKeeper(vsureService, appLifecycle)
+	sessionKeeper.Start(rootCtx)
 
-	fimpRouter := router.NewFromFimpRouter(mqtt, appLifecycle, configs, vsureService, states)
+	fimpRouter := router.NewFromFimpRouter(mqtt, appLifecycle, configs, vsureService, states, sessionKeeper, loginKey)
 	fimpRouter.Start()
 	//------------------ Remote API check -- !!!!IMPORTANT!!!!-------------
 	// The app MUST perform remote API availability check.
@@ -77,117 +118,32 @@ func main() {
 	if err != nil {
 		PollTime = 5
 	}
-	for {
+	poller := router.NewPoller(mqtt, appLifecycle, configs, vsureService, states, sessionKeeper, time.Duration(PollTime)*time.Minute)
+
+	for rootCtx.Err() == nil {
 		appLifecycle.WaitForState("main", edgeapp.SystemEventTypeState, edgeapp.AppStateRunning)
 		log.Info("Starting ticker")
 		ticker := time.NewTicker(time.Duration(PollTime) * time.Minute)
-		for ; true; <-ticker.C {
-			if configs.Installation == "" {
-				log.Debug("No installation is setup")
-				continue
-			}
-
-			vsureService.SetGIID(configs.Installation)
-
-			if err := vsureService.UpdateToken(); err != nil {
-				log.Error(err)
-				appLifecycle.SetConnectionState(edgeapp.ConnStateDisconnected)
-				continue
-			}
-
-			appLifecycle.SetConnectionState(edgeapp.ConnStateConnected)
-
-			installationState, err := vsureService.FetchInstallationState()
-			if err != nil {
-				log.Error(err)
-				continue
-			}
-
-			if installationState != nil {
-
-				for _, climate := range installationState.Climates {
-					deviceId := strings.ReplaceAll(climate.Device.DeviceLabel, " ", "")
-
-					bk := states.GetClimateByDeviceLabel(climate.Device.DeviceLabel)
-					if bk != nil && climate.TemperatureTimestamp == bk.TemperatureTimestamp {
-						continue
-					}
-					tempVal := climate.TemperatureValue
-					props := fimpgo.Props{}
-					props["unit"] = "C"
-
-					adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_temp", ServiceAddress: deviceId}
-					msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, tempVal, props, nil, nil)
-					mqtt.Publish(adr, msg)
-
-					if climate.HumidityEnabled {
-						humidityVal := climate.HumidityValue
-						props := fimpgo.Props{}
-						props["unit"] = "%"
-
-						adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_humid", ServiceAddress: deviceId}
-						msg := fimpgo.NewMessage("evt.sensor.report", "sensor_humid", fimpgo.VTypeFloat, humidityVal, props, nil, nil)
-						mqtt.Publish(adr, msg)
-					}
-				}
-				states.Climates = installationState.Climates
-
-				for _, daw := range installationState.DoorWindows {
-					deviceId := strings.ReplaceAll(daw.Device.DeviceLabel, " ", "")
-					bk := states.GetDoorWindowByDeviceLabel(daw.Device.DeviceLabel)
-					if bk != nil && daw.ReportTime == bk.ReportTime {
-						continue
-					}
-
-					stateVal := false
-					if daw.State == "OPEN" {
-						stateVal = true
-					}
-
-					adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_contact", ServiceAddress: deviceId}
-					msg := fimpgo.NewMessage("evt.open.report", "sensor_contact", fimpgo.VTypeBool, stateVal, nil, nil, nil)
-					mqtt.Publish(adr, msg)
-				}
-
-				states.DoorWindows = installationState.DoorWindows
-
-				for _, smartLock := range installationState.SmartLocks {
-					deviceId := strings.ReplaceAll(smartLock.Device.DeviceLabel, " ", "")
-					bk := states.GetSmartLockByDeviceLabel(smartLock.Device.DeviceLabel)
-					if bk != nil && smartLock.EventTime == bk.EventTime {
-						continue
-					}
-
-					stateVal := &model.LockState{}
-
-					trueVal := true
-					falseVal := false
-					if smartLock.LockStatus == "LOCKED" {
-						stateVal.IsSecured = &trueVal
-					} else {
-						stateVal.IsSecured = &falseVal
-					}
-
-					props := fimpgo.Props{}
-					if smartLock.LockMethod == "CODE" {
-						props["lock_type"] = "PIN"
-					} else {
-						props["lock_type"] = "KEY"
-					}
-
-					adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "door_lock", ServiceAddress: deviceId}
-					msg := fimpgo.NewMessage("evt.lock.report", "door_lock", fimpgo.VTypeBoolMap, stateVal, props, nil, nil)
-					mqtt.Publish(adr, msg)
-				}
-
-				states.SmartLocks = installationState.SmartLocks
-
-				states.SaveToFile()
-			}
+		for ; rootCtx.Err() == nil; waitForTick(rootCtx, ticker.C) {
+			ctx, cancel := context.WithTimeout(rootCtx, pollTimeout)
+			poller.Poll(ctx)
+			cancel()
+		}
+		ticker.Stop()
+		if rootCtx.Err() == nil {
+			appLifecycle.WaitForState("main", edgeapp.SystemEventTypeState, edgeapp.AppStateNotConfigured)
 		}
-		appLifecycle.WaitForState("main", edgeapp.SystemEventTypeState, edgeapp.AppStateNotConfigured)
 	}
 
+	fimpRouter.Stop()
 	mqtt.Stop()
 	time.Sleep(5 * time.Second)
 }
+
+// waitForTick blocks until the next tick or until ctx is cancelled.
+func waitForTick(ctx context.Context, tick <-chan time.Time) {
+	select {
+	case <-tick:
+	case <-ctx.Done():
+	}
+}
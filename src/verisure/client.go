@@ -2,51 +2,176 @@ package verisure
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/thingsplex/verisure/model"
 )
 
+// Client talks to the Verisure API. Every method that sends requests has a ...Context variant,
+// where the context bounds the whole call including retries; the plain variant uses context.Background.
+// The client locks the states itself while it reads or writes them, so callers must not hold the lock when calling it.
 type Client struct {
 	states *model.States
-	giid   string
+
+	httpClient     *http.Client
+	applicationID  string
+	requestTimeout time.Duration
+	retry          retryPolicy
+	budget         *requestBudget
+	lockPoll       time.Duration
+
+	mu       sync.Mutex
+	baseURLs []string
+	giid     string
 }
 
 var (
-	baseURLS = []string{"https://m-api01.verisure.com",
+	defaultBaseURLs = []string{"https://m-api01.verisure.com",
 		"https://m-api02.verisure.com"}
-	applicationID = "DK_FUTUREHOME"
+	defaultApplicationID = "DK_FUTUREHOME"
+
+	// ErrMFARequired is returned by Login when the account needs a verification code to complete the sign in.
+	ErrMFARequired = errors.New("verification code required")
 )
 
-func NewClient(states *model.States) (*Client, error) {
-	c := Client{states: states}
+func NewClient(states *model.States, opts ...Option) (*Client, error) {
+	c := Client{
+		states:        states,
+		httpClient:    http.DefaultClient,
+		applicationID: defaultApplicationID,
+		baseURLs:      append([]string{}, defaultBaseURLs...),
+		retry:         retryPolicy{maxAttempts: 4, minBackoff: 500 * time.Millisecond, maxBackoff: 30 * time.Second},
+		budget:        newRequestBudget(20, time.Minute),
+		lockPoll:      3 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	if len(c.baseURLs) == 0 {
+		return nil, errors.New("at least one base url is required")
+	}
+
+	if c.retry.maxAttempts < 1 {
+		c.retry.maxAttempts = 1
+	}
+
 	if states.GIID != "" {
 		c.giid = states.GIID
 	}
 
+	if err := states.MigrateCookies(c.baseURLs); err != nil {
+		log.Error(err)
+	}
+
 	return &c, nil
 }
 
-func (c *Client) request(method string, path string, requestBody []byte) ([]byte, error) {
+func (c *Client) getGIID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.giid
+}
+
+// getBaseURLs returns a copy of the servers in the order they should be tried.
+func (c *Client) getBaseURLs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.baseURLs...)
+}
+
+// switchBaseURL moves baseURL to the back of the list, so the next request starts with another server.
+func (c *Client) switchBaseURL(baseURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.baseURLs) < 2 || c.baseURLs[0] != baseURL {
+		return
+	}
+	c.baseURLs = append(c.baseURLs[1:], baseURL)
+}
+
+// do sends the request with the session cookies and the configured timeout, and returns the response with its body read.
+// Cookies set by the response are stored in the session, which saves itself when they change. The servers share the
+// session, so cookies without a domain are stored for each of them to keep the session after a server switch.
+func (c *Client) do(req *http.Request) (*http.Response, []byte, error) {
+	for _, cookie := range c.states.Session.Cookies(req.URL) {
+		req.AddCookie(cookie)
+	}
+
+	if c.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), c.requestTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	c.states.Session.SetCookies(req.URL, res.Cookies())
+	for _, baseURL := range c.getBaseURLs() {
+		if u, err := url.Parse(baseURL); err == nil && u.Host != req.URL.Host {
+			u.Path = req.URL.Path
+			c.states.Session.SetCookies(u, res.Cookies())
+		}
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return res, body, nil
+}
+
+// request sends a read, retrying on transport errors, 429 and 5xx responses.
+func (c *Client) request(ctx context.Context, method string, path string, requestBody []byte) ([]byte, error) {
+	return c.send(ctx, method, path, requestBody, true)
+}
+
+// mutate sends a graphql mutation. It is only sent again if it can't have reached Verisure, i.e. the connection
+// failed or Verisure asked for another server, so that e.g. an unlock that timed out isn't carried out twice.
+func (c *Client) mutate(ctx context.Context, requestBody []byte) ([]byte, error) {
+	return c.send(ctx, http.MethodPost, "/graphql", requestBody, false)
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, requestBody []byte, idempotent bool) ([]byte, error) {
 	path = strings.TrimLeft(path, "/")
 
-	var URLS []string
+	var lastErr error
+	var delay time.Duration
+	for attempt := 0; attempt < c.retry.maxAttempts; attempt++ {
+		if delay > 0 {
+			log.Debugf("Retrying in %s", delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
 
-	URLS = append(URLS, baseURLS...)
+		if err := c.budget.take(c.getGIID()); err != nil {
+			return nil, err
+		}
 
-	for _, baseURL := range URLS {
+		baseURL := c.getBaseURLs()[0]
 		url := fmt.Sprintf("%s/%s", baseURL, path)
 		log.Debugf("%s - %s", method, url)
 
-		req, err := http.NewRequest(method, url, bytes.NewReader(requestBody))
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(requestBody))
 		if err != nil {
 			return nil, err
 		}
@@ -55,59 +180,81 @@ func (c *Client) request(method string, path string, requestBody []byte) ([]byte
 			req.Header.Add("Content-Type", "application/json")
 		}
 
-		req.Header.Add("APPLICATION_ID", applicationID)
-		for _, cookie := range c.states.Cookies {
-			req.AddCookie(cookie)
-		}
+		req.Header.Add("APPLICATION_ID", c.applicationID)
 
-		res, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return nil, err
-		}
-		defer res.Body.Close()
-		body, err := ioutil.ReadAll(res.Body)
+		res, body, err := c.do(req)
 		if err != nil {
-			return nil, err
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Debug(err)
+			lastErr = err
+			c.switchBaseURL(baseURL)
+			if !idempotent && !isDialError(err) {
+				return nil, err
+			}
+			delay = c.retry.backoff(attempt)
+			continue
 		}
 
-		if res.StatusCode < http.StatusOK && res.StatusCode >= http.StatusMultipleChoices {
-			return body, fmt.Errorf("got %d from %s", res.StatusCode, url)
+		if res.StatusCode == http.StatusTooManyRequests {
+			lastErr = &HTTPError{StatusCode: res.StatusCode, URL: url, Body: body}
+			wait := retryAfter(res)
+			if wait > c.retry.maxBackoff {
+				c.budget.block(c.getGIID(), time.Now().Add(wait))
+				return body, errorFromBody(body, lastErr)
+			}
+			if !idempotent {
+				return body, errorFromBody(body, lastErr)
+			}
+			delay = c.retry.backoff(attempt)
+			if wait > delay {
+				delay = wait
+			}
+			continue
 		}
 
-		if res.StatusCode == http.StatusOK {
-			if strings.Contains(string(body), "SYS_00004") {
-				for i, j := 0, len(baseURLS)-1; i < j; i, j = i+1, j-1 {
-					baseURLS[i], baseURLS[j] = baseURLS[j], baseURLS[i]
-				}
-				continue
+		if res.StatusCode >= http.StatusInternalServerError {
+			lastErr = &HTTPError{StatusCode: res.StatusCode, URL: url, Body: body}
+			c.switchBaseURL(baseURL)
+			if !idempotent {
+				return body, errorFromBody(body, lastErr)
 			}
+			delay = c.retry.backoff(attempt)
+			continue
+		}
 
-			cookieUpdated := false
-			for i, cookie := range res.Cookies() {
-				if cookie.Name == "vs-access" {
-					for _, oldCookie := range c.states.Cookies {
-						if oldCookie.Name == "vs-access" && oldCookie.RawExpires != cookie.RawExpires {
-							c.states.Cookies[i] = cookie
-							cookieUpdated = true
-						}
-					}
-				}
-			}
+		if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+			return body, errorFromBody(body, &HTTPError{StatusCode: res.StatusCode, URL: url, Body: body})
+		}
 
-			if cookieUpdated {
-				c.states.SaveToFile()
-			}
+		if strings.Contains(string(body), ErrorCodeServerSwitch) {
+			lastErr = fmt.Errorf("%s asked to use another server", baseURL)
+			c.switchBaseURL(baseURL)
+			delay = 0
+			continue
 		}
 
-		return body, err
+		return body, nil
 	}
-	return nil, errors.New("failed to request")
+
+	if lastErr == nil {
+		lastErr = errors.New("failed to request")
+	}
+	if httpErr, ok := lastErr.(*HTTPError); ok {
+		return nil, errorFromBody(httpErr.Body, httpErr)
+	}
+	return nil, lastErr
 }
 
 func (c *Client) Login(username string, password string) error {
+	return c.LoginContext(context.Background(), username, password)
+}
+
+func (c *Client) LoginContext(ctx context.Context, username string, password string) error {
 	accessCookie := c.states.GetCookieByName("vs-access")
 	if accessCookie != nil {
-		err := c.UpdateToken()
+		err := c.UpdateTokenContext(ctx)
 		if err == nil {
 			return nil
 		}
@@ -115,36 +262,129 @@ func (c *Client) Login(username string, password string) error {
 
 	log.Debug("Do a sign in")
 
-	url := fmt.Sprintf("%s/%s", baseURLS[0], "auth/login")
+	url := fmt.Sprintf("%s/%s", c.getBaseURLs()[0], "auth/login")
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
 
-	req.Header.Add("APPLICATION_ID", applicationID)
+	req.Header.Add("APPLICATION_ID", c.applicationID)
 
 	b := fmt.Sprintf("%s:%s", username, password)
 	se := base64.StdEncoding.EncodeToString([]byte(b))
 
 	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", se))
 
-	res, err := http.DefaultClient.Do(req)
+	c.states.Lock()
+	trustCookie := c.states.GetTrustCookie(username)
+	c.states.Unlock()
+	if trustCookie != nil {
+		req.AddCookie(trustCookie)
+	}
+
+	res, body, err := c.do(req)
 	if err != nil {
 		return err
 	}
 
 	if res.StatusCode == http.StatusOK {
-		c.states.Cookies = res.Cookies()
+		c.states.Lock()
 		c.states.Username = username
 		c.states.SaveToFile()
+		c.states.Unlock()
+
+		login := &LoginResponse{}
+		if err := json.Unmarshal(body, login); err == nil && login.StepUpToken != "" {
+			return ErrMFARequired
+		}
 		return nil
 	}
 
 	return errors.New("failed to login")
 }
 
+func (c *Client) RequestMFACode(method string) error {
+	return c.RequestMFACodeContext(context.Background(), method)
+}
+
+// RequestMFACodeContext asks Verisure to send a verification code by sms or email for a login that returned ErrMFARequired.
+func (c *Client) RequestMFACodeContext(ctx context.Context, method string) error {
+	mfaType := "phone"
+	if method == model.MFAMethodEmail {
+		mfaType = "email"
+	}
+
+	res, _, err := c.authRequest(ctx, http.MethodPost, fmt.Sprintf("auth/mfa?type=%s", mfaType), nil)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to request verification code, got %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func (c *Client) ValidateMFACode(code string) error {
+	return c.ValidateMFACodeContext(context.Background(), code)
+}
+
+// ValidateMFACodeContext completes a login with the verification code and stores the trust token for later logins.
+func (c *Client) ValidateMFACodeContext(ctx context.Context, code string) error {
+	payload, err := json.Marshal(map[string]string{"token": code})
+	if err != nil {
+		return err
+	}
+
+	res, _, err := c.authRequest(ctx, http.MethodPost, "auth/mfa/validate", payload)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New("invalid verification code")
+	}
+
+	res, _, err = c.authRequest(ctx, http.MethodPost, "auth/trust", nil)
+	c.states.Lock()
+	defer c.states.Unlock()
+	if err != nil {
+		log.Error(err)
+	} else {
+		for _, cookie := range res.Cookies() {
+			if strings.HasPrefix(cookie.Name, "vs-trust") {
+				c.states.Trust = &model.TrustToken{Username: c.states.Username, Cookie: cookie}
+			}
+		}
+	}
+
+	return c.states.SaveToFile()
+}
+
+func (c *Client) authRequest(ctx context.Context, method string, path string, requestBody []byte) (*http.Response, []byte, error) {
+	url := fmt.Sprintf("%s/%s", c.getBaseURLs()[0], path)
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if requestBody != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	req.Header.Add("APPLICATION_ID", c.applicationID)
+
+	return c.do(req)
+}
+
 func (c *Client) UpdateToken() error {
+	return c.UpdateTokenContext(context.Background())
+}
+
+func (c *Client) UpdateTokenContext(ctx context.Context) error {
 	now := time.Now()
 
 	accessCookie := c.states.GetCookieByName("vs-access")
@@ -153,33 +393,108 @@ func (c *Client) UpdateToken() error {
 		return nil
 	}
 
+	return c.RefreshTokenContext(ctx)
+}
+
+func (c *Client) RefreshToken() error {
+	return c.RefreshTokenContext(context.Background())
+}
+
+// RefreshTokenContext gets a new access cookie even if the current one looks valid, e.g. after Verisure reported ErrSessionExpired.
+func (c *Client) RefreshTokenContext(ctx context.Context) error {
+	now := time.Now()
+
 	refreshCookie := c.states.GetCookieByName("vs-refresh")
 	if refreshCookie == nil {
 		return errors.New("no refresh cookie found")
 	}
 
-	if now.After(refreshCookie.Expires) {
+	if !refreshCookie.Expires.IsZero() && now.After(refreshCookie.Expires) {
 		return errors.New("refresh cookie expired")
 	}
 
 	log.Debug("Refresh please")
-	_, err := c.request(http.MethodGet, "/auth/token", nil)
+	_, err := c.request(ctx, http.MethodGet, "/auth/token", nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) SetTokens(username string, accessToken string, refreshToken string, expiresIn time.Duration) error {
+	return c.SetTokensContext(context.Background(), username, accessToken, refreshToken, expiresIn)
+}
+
+// SetTokensContext replaces the session with the access and refresh cookie values of a Verisure session from elsewhere,
+// and checks them by refreshing the session and fetching the installations of the user. The session is cleared if they
+// don't work. The expiry of the refresh cookie isn't known, so it is kept until Verisure rejects it.
+func (c *Client) SetTokensContext(ctx context.Context, username string, accessToken string, refreshToken string, expiresIn time.Duration) error {
+	if err := c.states.Session.Clear(); err != nil {
+		return err
+	}
+
+	access := &http.Cookie{Name: "vs-access", Value: accessToken}
+	if expiresIn > 0 {
+		access.Expires = time.Now().Add(expiresIn)
+	}
+	c.states.Session.Import([]*http.Cookie{access, {Name: "vs-refresh", Value: refreshToken}}, c.getBaseURLs())
+
+	c.states.Lock()
+	c.states.Username = username
+	c.states.Unlock()
+	err := c.RefreshTokenContext(ctx)
+	if err == nil {
+		_, err = c.FetchAllInstallationsContext(ctx)
+	}
+	c.states.Lock()
+	defer c.states.Unlock()
+	if err != nil {
+		c.states.Username = ""
+		if clearErr := c.states.Session.Clear(); clearErr != nil {
+			log.Error(clearErr)
+		}
+		return err
+	}
+	return c.states.SaveToFile()
+}
+
+func (c *Client) Logout() error {
+	return c.LogoutContext(context.Background())
+}
+
+// LogoutContext ends the session at Verisure. The local session is cleared even if Verisure can't be reached.
+func (c *Client) LogoutContext(ctx context.Context) error {
+	res, _, err := c.authRequest(ctx, http.MethodDelete, "auth/logout", nil)
+	if clearErr := c.states.Session.Clear(); clearErr != nil {
+		log.Error(clearErr)
+	}
 	if err != nil {
 		return err
 	}
 
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to log out, got %d", res.StatusCode)
+	}
+
 	return nil
 }
 
 func (c *Client) FetchAllInstallations() ([]model.Installation, error) {
+	return c.FetchAllInstallationsContext(context.Background())
+}
 
-	if c.states.Username == "" {
+func (c *Client) FetchAllInstallationsContext(ctx context.Context) ([]model.Installation, error) {
+	c.states.Lock()
+	username := c.states.Username
+	c.states.Unlock()
+	if username == "" {
 		return nil, errors.New("must set installation to get installations")
 	}
 
 	q := GraphQLQuery{
 		OperationName: "fetchAllInstallations",
-		Variables:     map[string]interface{}{"email": c.states.Username},
+		Variables:     map[string]interface{}{"email": username},
 		Query:         "query fetchAllInstallations($email: String!){\n  account(email: $email) {\n    installations {\n      giid\n      alias\n      customerType\n      dealerId\n      subsidiary\n      pinCodeLength\n      locale\n      address {\n        street\n        city\n        postalNumber\n        __typename\n      }\n      __typename\n    }\n    __typename\n  }\n}\n",
 	}
 
@@ -188,7 +503,7 @@ func (c *Client) FetchAllInstallations() ([]model.Installation, error) {
 		return nil, err
 	}
 
-	body, err := c.request(http.MethodPost, "/graphql", payload)
+	body, err := c.request(ctx, http.MethodPost, "/graphql", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -199,22 +514,32 @@ func (c *Client) FetchAllInstallations() ([]model.Installation, error) {
 		return nil, err
 	}
 
-	if response.Data != nil && response.Data.Account.Installations != nil {
+	if response.Data != nil && response.Data.Account != nil && response.Data.Account.Installations != nil {
+		response.logPartialErrors()
 		return response.Data.Account.Installations, nil
 	}
 
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+
 	return nil, errors.New("failed to fetch installations")
 }
 
 func (c *Client) FetchInstallationState() (*model.Installation, error) {
-	if c.giid == "" {
+	return c.FetchInstallationStateContext(context.Background())
+}
+
+func (c *Client) FetchInstallationStateContext(ctx context.Context) (*model.Installation, error) {
+	giid := c.getGIID()
+	if giid == "" {
 		return nil, errors.New("must set installation to get climate")
 	}
 
 	q := GraphQLQuery{
 		OperationName: "GetState",
-		Variables:     map[string]interface{}{"giid": c.giid},
-		Query:         "query GetState($giid: String!) {\n  installation(giid: $giid) {\n    doorWindows {\n      device {\n        deviceLabel\n      }\n      state\n      reportTime\n    }\n    climates {\n      device {\n        deviceLabel\n      }\n      humidityEnabled\n      humidityTimestamp\n      humidityValue\n      temperatureTimestamp\n      temperatureValue\n    }\n    smartLocks {\n      device {\n        deviceLabel\n      }\n      lockStatus\n      doorState\n      lockMethod\n      eventTime\n      doorLockType\n      secureMode\n      user {\n        name\n      }\n    }\n    armState {\n      type\n      statusType\n      date\n      name\n      changedVia\n    }\n    smartplugs {\n      device {\n        deviceLabel\n      }\n      currentState\n      icon\n      isHazardous\n    }\n  }\n}\n",
+		Variables:     map[string]interface{}{"giid": giid},
+		Query:         "query GetState($giid: String!) {\n  installation(giid: $giid) {\n    doorWindows {\n      device {\n        deviceLabel\n        area\n        gui {\n          label\n        }\n      }\n      state\n      reportTime\n    }\n    climates {\n      device {\n        deviceLabel\n        area\n        gui {\n          label\n        }\n      }\n      humidityEnabled\n      humidityTimestamp\n      humidityValue\n      temperatureTimestamp\n      temperatureValue\n    }\n    smartLocks {\n      device {\n        deviceLabel\n        area\n        gui {\n          label\n        }\n      }\n      lockStatus\n      doorState\n      lockMethod\n      eventTime\n      doorLockType\n      secureMode\n      user {\n        name\n      }\n    }\n    armState {\n      type\n      statusType\n      date\n      name\n      changedVia\n    }\n    smartplugs {\n      device {\n        deviceLabel\n        area\n        gui {\n          label\n        }\n      }\n      currentState\n      icon\n      isHazardous\n    }\n  }\n}\n",
 	}
 
 	payload, err := json.Marshal(q)
@@ -222,7 +547,7 @@ func (c *Client) FetchInstallationState() (*model.Installation, error) {
 		return nil, err
 	}
 
-	body, err := c.request(http.MethodPost, "/graphql", payload)
+	body, err := c.request(ctx, http.MethodPost, "/graphql", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -234,20 +559,30 @@ func (c *Client) FetchInstallationState() (*model.Installation, error) {
 	}
 
 	if response.Data != nil && response.Data.Installation != nil {
+		response.logPartialErrors()
 		return response.Data.Installation, nil
 	}
 
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+
 	return nil, errors.New("failed to fetch climates")
 }
 
 func (c *Client) FetchClimate() ([]model.ClimateDevice, error) {
-	if c.giid == "" {
+	return c.FetchClimateContext(context.Background())
+}
+
+func (c *Client) FetchClimateContext(ctx context.Context) ([]model.ClimateDevice, error) {
+	giid := c.getGIID()
+	if giid == "" {
 		return nil, errors.New("must set installation to get climate")
 	}
 
 	q := GraphQLQuery{
 		OperationName: "Climate",
-		Variables:     map[string]interface{}{"giid": c.giid},
+		Variables:     map[string]interface{}{"giid": giid},
 		Query:         "query Climate($giid: String!) {\n  installation(giid: $giid) {\n    climates {\n      device {\n        deviceLabel\n        area\n        gui {\n          label\n          __typename\n        }\n        __typename\n      }\n      humidityEnabled\n      humidityTimestamp\n      humidityValue\n      temperatureTimestamp\n      temperatureValue\n      thresholds {\n        aboveMaxAlert\n        belowMinAlert\n        sensorType\n        __typename\n      }\n      __typename\n    }\n    __typename\n  }\n}\n",
 	}
 
@@ -256,7 +591,7 @@ func (c *Client) FetchClimate() ([]model.ClimateDevice, error) {
 		return nil, err
 	}
 
-	body, err := c.request(http.MethodPost, "/graphql", payload)
+	body, err := c.request(ctx, http.MethodPost, "/graphql", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -267,21 +602,31 @@ func (c *Client) FetchClimate() ([]model.ClimateDevice, error) {
 		return nil, err
 	}
 
-	if response.Data != nil && response.Data.Installation.Climates != nil {
+	if response.Data != nil && response.Data.Installation != nil && response.Data.Installation.Climates != nil {
+		response.logPartialErrors()
 		return response.Data.Installation.Climates, nil
 	}
 
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+
 	return nil, errors.New("failed to fetch climates")
 }
 
 func (c *Client) FetchDoorWindow() ([]model.DoorWindowDevice, error) {
-	if c.giid == "" {
+	return c.FetchDoorWindowContext(context.Background())
+}
+
+func (c *Client) FetchDoorWindowContext(ctx context.Context) ([]model.DoorWindowDevice, error) {
+	giid := c.getGIID()
+	if giid == "" {
 		return nil, errors.New("must set installation to get door and windows")
 	}
 
 	q := GraphQLQuery{
 		OperationName: "DoorWindow",
-		Variables:     map[string]interface{}{"giid": c.giid},
+		Variables:     map[string]interface{}{"giid": giid},
 		Query:         "query DoorWindow($giid: String!) {\n  installation(giid: $giid) {\n    doorWindows {\n      device {\n        deviceLabel\n        area\n        gui {\n          label\n          __typename\n        }\n        __typename\n      }\n      type\n      area\n      state\n      wired\n      reportTime\n      __typename\n    }\n    __typename\n  }\n}\n",
 	}
 
@@ -290,7 +635,7 @@ func (c *Client) FetchDoorWindow() ([]model.DoorWindowDevice, error) {
 		return nil, err
 	}
 
-	body, err := c.request(http.MethodPost, "/graphql", payload)
+	body, err := c.request(ctx, http.MethodPost, "/graphql", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -301,22 +646,32 @@ func (c *Client) FetchDoorWindow() ([]model.DoorWindowDevice, error) {
 		return nil, err
 	}
 
-	if response.Data != nil && response.Data.Installation.DoorWindows != nil {
+	if response.Data != nil && response.Data.Installation != nil && response.Data.Installation.DoorWindows != nil {
+		response.logPartialErrors()
 		return response.Data.Installation.DoorWindows, nil
 	}
 
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+
 	return nil, errors.New("failed to fetch door and windows")
 }
 
 func (c *Client) LockSmartLock(deviceLabel string, code string) error {
-	if c.giid == "" {
+	return c.LockSmartLockContext(context.Background(), deviceLabel, code)
+}
+
+func (c *Client) LockSmartLockContext(ctx context.Context, deviceLabel string, code string) error {
+	giid := c.getGIID()
+	if giid == "" {
 		return errors.New("must set installation to lock smart locks")
 	}
 
 	q := GraphQLQuery{
 		OperationName: "DoorLock",
 		Variables: map[string]interface{}{
-			"giid":        c.giid,
+			"giid":        giid,
 			"deviceLabel": deviceLabel,
 			"input": map[string]interface{}{
 				"code": code,
@@ -330,7 +685,7 @@ func (c *Client) LockSmartLock(deviceLabel string, code string) error {
 		return err
 	}
 
-	body, err := c.request(http.MethodPost, "/graphql", payload)
+	body, err := c.mutate(ctx, payload)
 	if err != nil {
 		return err
 	}
@@ -341,22 +696,23 @@ func (c *Client) LockSmartLock(deviceLabel string, code string) error {
 		return err
 	}
 
-	if response.Errors != nil {
-		return errors.New(response.Errors[0].Message)
-	}
-
-	return nil
+	return response.Error()
 }
 
 func (c *Client) UnlockSmartLock(deviceLabel string, code string) error {
-	if c.giid == "" {
+	return c.UnlockSmartLockContext(context.Background(), deviceLabel, code)
+}
+
+func (c *Client) UnlockSmartLockContext(ctx context.Context, deviceLabel string, code string) error {
+	giid := c.getGIID()
+	if giid == "" {
 		return errors.New("must set installation to lock smart locks")
 	}
 
 	q := GraphQLQuery{
 		OperationName: "DoorUnlock",
 		Variables: map[string]interface{}{
-			"giid":        c.giid,
+			"giid":        giid,
 			"deviceLabel": deviceLabel,
 			"input": map[string]interface{}{
 				"code": code,
@@ -370,7 +726,7 @@ func (c *Client) UnlockSmartLock(deviceLabel string, code string) error {
 		return err
 	}
 
-	body, err := c.request(http.MethodPost, "/graphql", payload)
+	body, err := c.mutate(ctx, payload)
 	if err != nil {
 		return err
 	}
@@ -381,21 +737,167 @@ func (c *Client) UnlockSmartLock(deviceLabel string, code string) error {
 		return err
 	}
 
-	if response.Errors != nil {
-		return errors.New(response.Errors[0].Message)
+	return response.Error()
+}
+
+func (c *Client) FetchSmartLockConfig(deviceLabel string) (*model.SmartLockConfiguration, error) {
+	return c.FetchSmartLockConfigContext(context.Background(), deviceLabel)
+}
+
+func (c *Client) FetchSmartLockConfigContext(ctx context.Context, deviceLabel string) (*model.SmartLockConfiguration, error) {
+	giid := c.getGIID()
+	if giid == "" {
+		return nil, errors.New("must set installation to get smart lock configuration")
 	}
 
-	return nil
+	q := GraphQLQuery{
+		OperationName: "DoorLockConfiguration",
+		Variables: map[string]interface{}{
+			"giid":        giid,
+			"deviceLabel": deviceLabel,
+		},
+		Query: "query DoorLockConfiguration($giid: String!, $deviceLabel: String!) {\n  installation(giid: $giid) {\n    smartLocks(filter: {deviceLabels: [$deviceLabel]}) {\n      device {\n        deviceLabel\n        __typename\n      }\n      configuration {\n        ... on YaleLockConfiguration {\n          autoLockEnabled\n          volume\n          voiceLevel\n          __typename\n        }\n        __typename\n      }\n      __typename\n    }\n    __typename\n  }\n}\n",
+	}
+
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.request(ctx, http.MethodPost, "/graphql", payload)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GraphQLResponse{}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Data != nil && response.Data.Installation != nil {
+		for _, smartLock := range response.Data.Installation.SmartLocks {
+			if smartLock.Device.DeviceLabel == deviceLabel && smartLock.Configuration != nil {
+				response.logPartialErrors()
+				return smartLock.Configuration, nil
+			}
+		}
+	}
+
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+
+	return nil, errors.New("failed to fetch smart lock configuration")
+}
+
+func (c *Client) SetSmartLockConfig(deviceLabel string, config model.SmartLockConfiguration) error {
+	return c.SetSmartLockConfigContext(context.Background(), deviceLabel, config)
+}
+
+// SetSmartLockConfigContext updates the settings that are set in config and leaves the others unchanged.
+func (c *Client) SetSmartLockConfigContext(ctx context.Context, deviceLabel string, config model.SmartLockConfiguration) error {
+	giid := c.getGIID()
+	if giid == "" {
+		return errors.New("must set installation to configure smart locks")
+	}
+
+	input := map[string]interface{}{}
+	if config.AutoLockEnabled != nil {
+		input["autoLockEnabled"] = *config.AutoLockEnabled
+	}
+	if config.Volume != "" {
+		input["volume"] = config.Volume
+	}
+	if config.VoiceLevel != "" {
+		input["voiceLevel"] = config.VoiceLevel
+	}
+
+	q := GraphQLQuery{
+		OperationName: "DoorLockUpdateConfig",
+		Variables: map[string]interface{}{
+			"giid":        giid,
+			"deviceLabel": deviceLabel,
+			"input":       input,
+		},
+		Query: "mutation DoorLockUpdateConfig(\n  $giid: String!\n  $deviceLabel: String!\n  $input: DoorLockUpdateConfigInput!\n) {\n  DoorLockUpdateConfig(giid: $giid, deviceLabel: $deviceLabel, input: $input)\n}\n",
+	}
+
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+
+	body, err := c.mutate(ctx, payload)
+	if err != nil {
+		return err
+	}
+
+	response := &GraphQLResponse{}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return err
+	}
+
+	return response.Error()
+}
+
+func (c *Client) WaitForLockState(deviceLabel string, want string, previous time.Time) (*model.SmartLockDevice, error) {
+	return c.WaitForLockStateContext(context.Background(), deviceLabel, want, previous)
+}
+
+// WaitForLockStateContext polls the smart lock after a lock or unlock until it reports the wanted status,
+// or a new event with another status. previous is the event time of the lock before the operation.
+// It returns the lock as last seen, with ErrLockJammed or ErrLockTimeout if the operation did not complete.
+func (c *Client) WaitForLockStateContext(ctx context.Context, deviceLabel string, want string, previous time.Time) (*model.SmartLockDevice, error) {
+	var last *model.SmartLockDevice
+	for {
+		locks, err := c.FetchSmartLockContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return last, ErrLockTimeout
+			}
+			return last, err
+		}
+		for i := range locks {
+			if locks[i].Device.DeviceLabel == deviceLabel {
+				last = &locks[i]
+			}
+		}
+
+		if last != nil && last.LockStatus != model.LockStatusPending {
+			if last.LockStatus == want {
+				return last, nil
+			}
+			if !last.EventTime.Equal(previous) {
+				if last.LockStatus == model.LockStatusJammed {
+					return last, ErrLockJammed
+				}
+				return last, fmt.Errorf("lock reported %s", strings.ToLower(last.LockStatus))
+			}
+		}
+
+		select {
+		case <-time.After(c.lockPoll):
+		case <-ctx.Done():
+			return last, ErrLockTimeout
+		}
+	}
 }
 
 func (c *Client) FetchSmartLock() ([]model.SmartLockDevice, error) {
-	if c.giid == "" {
+	return c.FetchSmartLockContext(context.Background())
+}
+
+func (c *Client) FetchSmartLockContext(ctx context.Context) ([]model.SmartLockDevice, error) {
+	giid := c.getGIID()
+	if giid == "" {
 		return nil, errors.New("must set installation to get smart locks")
 	}
 
 	q := GraphQLQuery{
 		OperationName: "SmartLock",
-		Variables:     map[string]interface{}{"giid": c.giid},
+		Variables:     map[string]interface{}{"giid": giid},
 		Query:         "query SmartLock($giid: String!) {\n  installation(giid: $giid) {\n    smartLocks {\n      device {\n        deviceLabel\n        area\n        gui {\n          label\n          __typename\n        }\n        __typename\n      }\n lockStatus\n      doorState\n      lockMethod\n      eventTime\n      doorLockType\n      secureMode\n      user {\n        name\n        __typename\n      }\n      __typename\n    }\n    __typename\n  }\n}\n",
 	}
 
@@ -404,7 +906,7 @@ func (c *Client) FetchSmartLock() ([]model.SmartLockDevice, error) {
 		return nil, err
 	}
 
-	body, err := c.request(http.MethodPost, "/graphql", payload)
+	body, err := c.request(ctx, http.MethodPost, "/graphql", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -415,21 +917,126 @@ func (c *Client) FetchSmartLock() ([]model.SmartLockDevice, error) {
 		return nil, err
 	}
 
-	if response.Data != nil && response.Data.Installation.SmartLocks != nil {
+	if response.Data != nil && response.Data.Installation != nil && response.Data.Installation.SmartLocks != nil {
+		response.logPartialErrors()
 		return response.Data.Installation.SmartLocks, nil
 	}
 
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+
 	return nil, errors.New("failed to fetch smart locks")
 }
 
+func (c *Client) FetchSmartPlug() ([]model.SmartPlugDevice, error) {
+	return c.FetchSmartPlugContext(context.Background())
+}
+
+func (c *Client) FetchSmartPlugContext(ctx context.Context) ([]model.SmartPlugDevice, error) {
+	giid := c.getGIID()
+	if giid == "" {
+		return nil, errors.New("must set installation to get smart plugs")
+	}
+
+	q := GraphQLQuery{
+		OperationName: "SmartPlug",
+		Variables:     map[string]interface{}{"giid": giid},
+		Query:         "query SmartPlug($giid: String!) {\n  installation(giid: $giid) {\n    smartplugs {\n      device {\n        deviceLabel\n        area\n        gui {\n          label\n          __typename\n        }\n        __typename\n      }\n      currentState\n      icon\n      isHazardous\n      __typename\n    }\n    __typename\n  }\n}\n",
+	}
+
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.request(ctx, http.MethodPost, "/graphql", payload)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &GraphQLResponse{}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Data != nil && response.Data.Installation != nil && response.Data.Installation.SmartPlugs != nil {
+		response.logPartialErrors()
+		return response.Data.Installation.SmartPlugs, nil
+	}
+
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+
+	return nil, errors.New("failed to fetch smart plugs")
+}
+
+func (c *Client) TurnOnSmartPlug(deviceLabel string) error {
+	return c.TurnOnSmartPlugContext(context.Background(), deviceLabel)
+}
+
+func (c *Client) TurnOnSmartPlugContext(ctx context.Context, deviceLabel string) error {
+	return c.setSmartPlugState(ctx, deviceLabel, true)
+}
+
+func (c *Client) TurnOffSmartPlug(deviceLabel string) error {
+	return c.TurnOffSmartPlugContext(context.Background(), deviceLabel)
+}
+
+func (c *Client) TurnOffSmartPlugContext(ctx context.Context, deviceLabel string) error {
+	return c.setSmartPlugState(ctx, deviceLabel, false)
+}
+
+func (c *Client) setSmartPlugState(ctx context.Context, deviceLabel string, state bool) error {
+	giid := c.getGIID()
+	if giid == "" {
+		return errors.New("must set installation to switch smart plugs")
+	}
+
+	q := GraphQLQuery{
+		OperationName: "UpdateState",
+		Variables: map[string]interface{}{
+			"giid":        giid,
+			"deviceLabel": deviceLabel,
+			"state":       state,
+		},
+		Query: "mutation UpdateState(\n  $giid: String!\n  $deviceLabel: String!\n  $state: Boolean!\n) {\n  SmartPlugSetState(giid: $giid, input: [{deviceLabel: $deviceLabel, state: $state}])\n}\n",
+	}
+
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+
+	body, err := c.mutate(ctx, payload)
+	if err != nil {
+		return err
+	}
+
+	response := &GraphQLResponse{}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return err
+	}
+
+	return response.Error()
+}
+
 func (c *Client) FetchUserTracking() ([]model.UserTracking, error) {
-	if c.giid == "" {
+	return c.FetchUserTrackingContext(context.Background())
+}
+
+func (c *Client) FetchUserTrackingContext(ctx context.Context) ([]model.UserTracking, error) {
+	giid := c.getGIID()
+	if giid == "" {
 		return nil, errors.New("must set installation to get user tracking")
 	}
 
 	q := GraphQLQuery{
 		OperationName: "userTrackings",
-		Variables:     map[string]interface{}{"giid": c.giid},
+		Variables:     map[string]interface{}{"giid": giid},
 		Query:         "query userTrackings($giid: String!) {\n  installation(giid: $giid) {\n    userTrackings {\n      isCallingUser\n      webAccount\n      status\n      xbnContactId\n      currentLocationName\n      deviceId\n      name\n      initials\n      currentLocationTimestamp\n      deviceName\n      currentLocationId\n      __typename\n    }\n    __typename\n  }\n}\n",
 	}
 
@@ -438,7 +1045,7 @@ func (c *Client) FetchUserTracking() ([]model.UserTracking, error) {
 		return nil, err
 	}
 
-	body, err := c.request(http.MethodPost, "/graphql", payload)
+	body, err := c.request(ctx, http.MethodPost, "/graphql", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -449,21 +1056,31 @@ func (c *Client) FetchUserTracking() ([]model.UserTracking, error) {
 		return nil, err
 	}
 
-	if response.Data != nil && response.Data.Installation.UserTrackings != nil {
+	if response.Data != nil && response.Data.Installation != nil && response.Data.Installation.UserTrackings != nil {
+		response.logPartialErrors()
 		return response.Data.Installation.UserTrackings, nil
 	}
 
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+
 	return nil, errors.New("failed to fetch user tracking")
 }
 
 func (c *Client) FetchArmState() (*model.ArmState, error) {
-	if c.giid == "" {
+	return c.FetchArmStateContext(context.Background())
+}
+
+func (c *Client) FetchArmStateContext(ctx context.Context) (*model.ArmState, error) {
+	giid := c.getGIID()
+	if giid == "" {
 		return nil, errors.New("must set installation to get arm state")
 	}
 
 	q := GraphQLQuery{
 		OperationName: "ArmState",
-		Variables:     map[string]interface{}{"giid": c.giid},
+		Variables:     map[string]interface{}{"giid": giid},
 		Query:         "query ArmState($giid: String!) {\n  installation(giid: $giid) {\n    armState {\n      type\n      statusType\n      date\n      name\n      changedVia\n      __typename\n    }\n    __typename\n  }\n}\n",
 	}
 
@@ -472,7 +1089,7 @@ func (c *Client) FetchArmState() (*model.ArmState, error) {
 		return nil, err
 	}
 
-	body, err := c.request(http.MethodPost, "/graphql", payload)
+	body, err := c.request(ctx, http.MethodPost, "/graphql", payload)
 	if err != nil {
 		return nil, err
 	}
@@ -483,18 +1100,87 @@ func (c *Client) FetchArmState() (*model.ArmState, error) {
 		return nil, err
 	}
 
-	if response.Data != nil && response.Data.Installation.ArmState != nil {
+	if response.Data != nil && response.Data.Installation != nil && response.Data.Installation.ArmState != nil {
+		response.logPartialErrors()
 		return response.Data.Installation.ArmState, nil
 	}
 
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+
 	return nil, errors.New("failed to fetch arm state")
 }
 
+func (c *Client) ArmAway(code string) error {
+	return c.ArmAwayContext(context.Background(), code)
+}
+
+func (c *Client) ArmAwayContext(ctx context.Context, code string) error {
+	return c.setArmState(ctx, "armAway", "mutation armAway($giid: String!, $code: String!) {\n  armStateArmAway(giid: $giid, code: $code)\n}\n", code)
+}
+
+func (c *Client) ArmHome(code string) error {
+	return c.ArmHomeContext(context.Background(), code)
+}
+
+func (c *Client) ArmHomeContext(ctx context.Context, code string) error {
+	return c.setArmState(ctx, "armHome", "mutation armHome($giid: String!, $code: String!) {\n  armStateArmHome(giid: $giid, code: $code)\n}\n", code)
+}
+
+func (c *Client) Disarm(code string) error {
+	return c.DisarmContext(context.Background(), code)
+}
+
+func (c *Client) DisarmContext(ctx context.Context, code string) error {
+	return c.setArmState(ctx, "disarm", "mutation disarm($giid: String!, $code: String!) {\n  armStateDisarm(giid: $giid, code: $code)\n}\n", code)
+}
+
+func (c *Client) setArmState(ctx context.Context, operationName string, query string, code string) error {
+	giid := c.getGIID()
+	if giid == "" {
+		return errors.New("must set installation to change arm state")
+	}
+
+	q := GraphQLQuery{
+		OperationName: operationName,
+		Variables: map[string]interface{}{
+			"giid": giid,
+			"code": code,
+		},
+		Query: query,
+	}
+
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+
+	body, err := c.mutate(ctx, payload)
+	if err != nil {
+		return err
+	}
+
+	response := &GraphQLResponse{}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		return err
+	}
+
+	return response.Error()
+}
+
 func (c *Client) SetGIID(giid string) error {
+	c.mu.Lock()
 	c.giid = giid
-	c.states.GIID = giid
+	c.mu.Unlock()
 
-	c.states.SaveToFile()
+	c.states.Lock()
+	defer c.states.Unlock()
+	if c.states.GIID == giid {
+		return nil
+	}
+	c.states.GIID = giid
 
-	return nil
+	return c.states.SaveToFile()
 }
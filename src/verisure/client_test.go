@@ -0,0 +1,234 @@
+package verisure_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thingsplex/verisure/model"
+	"github.com/thingsplex/verisure/verisure"
+	"github.com/thingsplex/verisure/verisure/fake"
+)
+
+const (
+	testGIID     = "123456789000"
+	testUsername = "user@example.com"
+	testPassword = "password"
+	testPin      = "123456"
+	testLock     = "CDEF GHIJ"
+)
+
+// newTestStates returns empty states saved in a temporary work dir.
+func newTestStates(t *testing.T) *model.States {
+	workDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(workDir, "data"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(workDir, "data", "state.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	states := model.NewStates(workDir)
+	if err := states.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	return states
+}
+
+// newTestClient returns a client for the installation of the fixture, talking to a fake server.
+func newTestClient(t *testing.T, opts ...verisure.Option) (*verisure.Client, *fake.Server) {
+	fixture, err := fake.LoadFixture("fake/testdata/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fake.NewServer(fixture)
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	opts = append([]verisure.Option{verisure.WithBaseURLs(httpServer.URL)}, opts...)
+	client, err := verisure.NewClient(newTestStates(t), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetGIID(testGIID)
+	return client, server
+}
+
+func TestLoginAndFetchInstallationState(t *testing.T) {
+	client, _ := newTestClient(t)
+
+	if err := client.Login(testUsername, "wrong"); err == nil {
+		t.Fatal("login with a wrong password succeeded")
+	}
+	if err := client.Login(testUsername, testPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	installation, err := client.FetchInstallationState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(installation.Climates) != 1 || len(installation.DoorWindows) != 1 || len(installation.SmartLocks) != 1 {
+		t.Errorf("got %d climates, %d doors and windows and %d locks, want 1 of each",
+			len(installation.Climates), len(installation.DoorWindows), len(installation.SmartLocks))
+	}
+	if installation.ArmState == nil {
+		t.Error("no arm state")
+	}
+}
+
+func TestRefreshExpiredSession(t *testing.T) {
+	client, server := newTestClient(t)
+	if err := client.Login(testUsername, testPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	server.ExpireSessions()
+	if _, err := client.FetchInstallationState(); !errors.Is(err, verisure.ErrSessionExpired) {
+		t.Fatalf("got %v, want ErrSessionExpired", err)
+	}
+	if err := client.RefreshToken(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FetchInstallationState(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetArmState(t *testing.T) {
+	client, server := newTestClient(t)
+	if err := client.Login(testUsername, testPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.ArmAway("000000"); !errors.Is(err, verisure.ErrWrongPin) {
+		t.Fatalf("got %v, want ErrWrongPin", err)
+	}
+	if err := client.ArmAway(testPin); err != nil {
+		t.Fatal(err)
+	}
+	if state := server.Installation(testGIID).ArmState.StatusType; state != model.ArmStateArmedAway {
+		t.Errorf("arm state is %s, want %s", state, model.ArmStateArmedAway)
+	}
+}
+
+func TestServerSwitchKeepsSession(t *testing.T) {
+	fixture, err := fake.LoadFixture("fake/testdata/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fake.NewServer(fixture)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	// The same server under two host names, like the Verisure API servers that share the session.
+	other := strings.Replace(httpServer.URL, "127.0.0.1", "localhost", 1)
+	client, err := verisure.NewClient(newTestStates(t), verisure.WithBaseURLs(httpServer.URL, other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetGIID(testGIID)
+	if err := client.Login(testUsername, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FetchSmartLock(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.SwitchServer(1)
+	if _, err := client.FetchSmartLock(); err != nil {
+		t.Fatalf("request after the server switch failed: %v", err)
+	}
+	// Later requests go to the other server.
+	if _, err := client.FetchSmartLock(); err != nil {
+		t.Fatalf("second request after the server switch failed: %v", err)
+	}
+}
+
+func TestLoginWithVerificationCode(t *testing.T) {
+	client, server := newTestClient(t)
+	server.RequireMFA("654321")
+
+	if err := client.Login(testUsername, testPassword); !errors.Is(err, verisure.ErrMFARequired) {
+		t.Fatalf("got %v, want %v", err, verisure.ErrMFARequired)
+	}
+	if err := client.RequestMFACode(model.MFAMethodSMS); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ValidateMFACode("000000"); err == nil {
+		t.Fatal("a wrong verification code was accepted")
+	}
+	if err := client.ValidateMFACode("654321"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.FetchInstallationState(); err != nil {
+		t.Fatalf("no session after the verification code: %v", err)
+	}
+
+	// The trust cookie stored with the code lets the next login skip it.
+	if err := client.Logout(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Login(testUsername, testPassword); err != nil {
+		t.Fatalf("got %v on the next login, want no verification code", err)
+	}
+	if _, err := client.FetchInstallationState(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeChecksSmartPlugCode(t *testing.T) {
+	fixture, err := fake.LoadFixture("fake/testdata/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fake.NewServer(fixture)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	access, _ := server.NewSession()
+
+	tests := []struct {
+		name    string
+		code    interface{}
+		wantErr error
+	}{
+		{"no code", nil, nil},
+		{"right code", testPin, nil},
+		{"wrong code", "000000", verisure.ErrWrongPin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			variables := map[string]interface{}{"giid": testGIID, "deviceLabel": "DEFG HIJK", "state": true}
+			if tt.code != nil {
+				variables["code"] = tt.code
+			}
+			payload, err := json.Marshal(verisure.GraphQLQuery{OperationName: "UpdateState", Variables: variables})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodPost, httpServer.URL+"/graphql", bytes.NewReader(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.AddCookie(&http.Cookie{Name: fake.AccessCookieName, Value: access})
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			response := &verisure.GraphQLResponse{}
+			if err := json.NewDecoder(res.Body).Decode(response); err != nil {
+				t.Fatal(err)
+			}
+			if err := response.Error(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package verisure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/verisure/model"
+)
+
+// Error codes returned by Verisure in errors[].data.errorCode.
+const (
+	ErrorCodeUnauthorized          = "AUT_00001"
+	ErrorCodeRateLimited           = "SYS_00003"
+	ErrorCodeServerSwitch          = "SYS_00004"
+	ErrorCodeInstallationNotFound  = "INS_00001"
+	ErrorCodeWrongPin              = "VAL_00819"
+	ErrorCodeLockBusy              = "DLS_00003"
+	ErrorCodeLockOperationRejected = "DLS_00002"
+)
+
+var (
+	ErrSessionExpired       = errors.New("session expired")
+	ErrWrongPin             = errors.New("wrong pin code")
+	ErrLockBusy             = errors.New("lock is busy")
+	ErrInstallationNotFound = errors.New("installation not found")
+	ErrRateLimited          = errors.New("rate limited")
+	ErrLockJammed           = errors.New("lock is jammed")
+	ErrLockTimeout          = errors.New("lock did not report a new state in time")
+)
+
+var errorCodes = map[string]error{
+	ErrorCodeUnauthorized:          ErrSessionExpired,
+	ErrorCodeRateLimited:           ErrRateLimited,
+	ErrorCodeInstallationNotFound:  ErrInstallationNotFound,
+	ErrorCodeWrongPin:              ErrWrongPin,
+	ErrorCodeLockBusy:              ErrLockBusy,
+	ErrorCodeLockOperationRejected: ErrLockBusy,
+}
+
+var errorGroups = map[string]error{
+	"UNAUTHORIZED":      ErrSessionExpired,
+	"TOO_MANY_REQUESTS": ErrRateLimited,
+}
+
+// Error is an error reported by the Verisure API. Use errors.Is with the Err* sentinels to check what kind it is.
+type Error struct {
+	Message    string
+	Code       string
+	Group      string
+	Status     int
+	LogTraceID string
+	Path       []string
+	kind       error
+}
+
+func newError(e *model.Errors) *Error {
+	err := &Error{
+		Message:    e.Message,
+		Code:       e.Data.ErrorCode,
+		Group:      e.Data.ErrorGroup,
+		Status:     e.Data.Status,
+		LogTraceID: e.Data.LogTraceID,
+		Path:       e.Path,
+	}
+	if e.Data.ErrorMessage != "" {
+		err.Message = e.Data.ErrorMessage
+	}
+
+	if kind, ok := errorCodes[err.Code]; ok {
+		err.kind = kind
+	} else if kind, ok := errorGroups[err.Group]; ok {
+		err.kind = kind
+	} else if err.Status == http.StatusUnauthorized {
+		err.kind = ErrSessionExpired
+	} else if err.Status == http.StatusTooManyRequests {
+		err.kind = ErrRateLimited
+	}
+	return err
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s (%s, trace %s)", e.Message, e.Code, e.LogTraceID)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+// Is lets HTTP errors match ErrSessionExpired and ErrRateLimited.
+func (e *HTTPError) Is(target error) bool {
+	switch target {
+	case ErrSessionExpired:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// Error returns the first error in the response, or nil if there is none.
+func (r *GraphQLResponse) Error() error {
+	if len(r.Errors) == 0 || r.Errors[0] == nil {
+		return nil
+	}
+	return newError(r.Errors[0])
+}
+
+// logPartialErrors logs errors that came back together with usable data, e.g. a single device type that failed to load.
+func (r *GraphQLResponse) logPartialErrors() {
+	for _, e := range r.Errors {
+		if e != nil {
+			log.Warn("Partial response from Verisure: ", newError(e))
+		}
+	}
+}
+
+// errorFromBody turns an error response into an *Error if the body holds GraphQL errors, falling back to fallback.
+func errorFromBody(body []byte, fallback error) error {
+	response := &GraphQLResponse{}
+	if err := json.Unmarshal(body, response); err != nil {
+		return fallback
+	}
+	if err := response.Error(); err != nil {
+		return err
+	}
+	return fallback
+}
@@ -0,0 +1,16 @@
+package verisure
+
+import (
+	"context"
+	"time"
+)
+
+// SetClock makes the keeper read the time from now, so tests can step through the login backoff without waiting.
+func (sk *SessionKeeper) SetClock(now func() time.Time) {
+	sk.now = now
+}
+
+// Check runs a single session check and returns when the keeper would check next.
+func (sk *SessionKeeper) Check(ctx context.Context) time.Time {
+	return sk.check(ctx)
+}
@@ -0,0 +1,43 @@
+package fake
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/thingsplex/verisure/model"
+)
+
+// Fixture is the account and installation state served by the fake backend.
+type Fixture struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// MFACode makes logins without a trust cookie require this verification code.
+	MFACode string `json:"mfa_code"`
+	// Pin is the user code accepted by lock, alarm and plug mutations.
+	Pin           string               `json:"pin"`
+	Installations []model.Installation `json:"installations"`
+}
+
+// LoadFixture reads a fixture from a json file.
+func LoadFixture(path string) (*Fixture, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fixture := &Fixture{}
+	err = json.Unmarshal(body, fixture)
+	if err != nil {
+		return nil, err
+	}
+	return fixture, nil
+}
+
+func (f *Fixture) getInstallation(giid string) *model.Installation {
+	for i := range f.Installations {
+		if f.Installations[i].Giid == giid {
+			return &f.Installations[i]
+		}
+	}
+	return nil
+}
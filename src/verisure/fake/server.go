@@ -0,0 +1,625 @@
+// Package fake is a stand-in for the Verisure API, serving fixture state for offline development and tests.
+//
+//	fixture, _ := fake.LoadFixture("testdata/fixture.json")
+//	server := httptest.NewServer(fake.NewServer(fixture))
+//	client, _ := verisure.NewClient(states, verisure.WithBaseURLs(server.URL))
+package fake
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thingsplex/verisure/model"
+	"github.com/thingsplex/verisure/verisure"
+)
+
+const (
+	AccessCookieName  = "vs-access"
+	RefreshCookieName = "vs-refresh"
+	StepUpCookieName  = "vs-stepup"
+	TrustCookieName   = "vs-trust"
+)
+
+type token struct {
+	name    string
+	expires time.Time
+}
+
+// Server implements the auth and graphql endpoints used by verisure.Client.
+type Server struct {
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	// LockDelay is how long a smart lock stays pending after a lock or unlock.
+	LockDelay time.Duration
+	// StatusDelay is how long a smart lock keeps reporting its previous state after a lock or unlock, before it
+	// turns pending.
+	StatusDelay time.Duration
+
+	mu          sync.Mutex
+	fixture     *Fixture
+	tokens      map[string]token
+	switchCount int
+	failures    []failure
+	busyLocks   map[string]string
+	jammedLocks map[string]bool
+	pending     map[string]pendingLock
+	operations  []string
+}
+
+type pendingLock struct {
+	status string
+	from   time.Time
+	until  time.Time
+}
+
+type failure struct {
+	status     int
+	retryAfter time.Duration
+}
+
+func NewServer(fixture *Fixture) *Server {
+	return &Server{
+		AccessTTL:   10 * time.Minute,
+		RefreshTTL:  24 * time.Hour,
+		LockDelay:   2 * time.Second,
+		fixture:     fixture,
+		tokens:      map[string]token{},
+		busyLocks:   map[string]string{},
+		jammedLocks: map[string]bool{},
+		pending:     map[string]pendingLock{},
+	}
+}
+
+// BusyLock makes the next lock or unlock of the lock fail with a lock busy error.
+func (s *Server) BusyLock(deviceLabel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busyLocks[deviceLabel] = verisure.ErrorCodeLockBusy
+}
+
+// RejectLock makes the next lock or unlock of the lock fail with a lock operation rejected error, which Verisure
+// returns when another operation of the lock is in progress.
+func (s *Server) RejectLock(deviceLabel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busyLocks[deviceLabel] = verisure.ErrorCodeLockOperationRejected
+}
+
+// JamLock makes the next lock or unlock of the lock end up jammed instead of in the requested state.
+func (s *Server) JamLock(deviceLabel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jammedLocks[deviceLabel] = true
+}
+
+// OperateLock changes the status of a smart lock with a new event time, as if it was locked or unlocked at the door.
+func (s *Server) OperateLock(deviceLabel string, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.fixture.Installations {
+		for j := range s.fixture.Installations[i].SmartLocks {
+			lock := &s.fixture.Installations[i].SmartLocks[j]
+			if lock.Device.DeviceLabel == deviceLabel {
+				lock.LockStatus = status
+				lock.LockMethod = "THUMBLATCH"
+				lock.User = model.User{}
+				lock.EventTime = time.Now().UTC()
+			}
+		}
+	}
+}
+
+// ExpireSessions makes every issued access cookie invalid, as if it had timed out.
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for value, t := range s.tokens {
+		if t.name == AccessCookieName {
+			t.expires = time.Now().Add(-time.Second)
+			s.tokens[value] = t
+		}
+	}
+}
+
+// NewSession returns the access and refresh cookie values of a new session, as if the user had logged in elsewhere.
+func (s *Server) NewSession() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	access := newTokenValue()
+	refresh := newTokenValue()
+	s.tokens[access] = token{name: AccessCookieName, expires: time.Now().Add(s.AccessTTL)}
+	s.tokens[refresh] = token{name: RefreshCookieName, expires: time.Now().Add(s.RefreshTTL)}
+	return access, refresh
+}
+
+// RequireMFA makes logins without a trust cookie require the verification code, like MFACode in the fixture.
+func (s *Server) RequireMFA(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fixture.MFACode = code
+}
+
+// SwitchServer answers the next n graphql requests with SYS_00004, telling the client to use another server.
+func (s *Server) SwitchServer(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.switchCount = n
+}
+
+// FailNext answers the next n graphql requests with the given status code, e.g. 429 or 503.
+// A non-zero retryAfter is sent in the Retry-After header.
+func (s *Server) FailNext(n int, status int, retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, failure{status: status, retryAfter: retryAfter})
+	}
+}
+
+// Operations returns the graphql operation names received so far.
+func (s *Server) Operations() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.operations...)
+}
+
+// Installation returns a copy of the current state of an installation.
+func (s *Server) Installation(giid string) *model.Installation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	installation := s.fixture.getInstallation(giid)
+	if installation == nil {
+		return nil
+	}
+	copied := *installation
+	return &copied
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch strings.TrimRight(r.URL.Path, "/") {
+	case "/auth/login":
+		s.handleLogin(w, r)
+	case "/auth/mfa":
+		s.handleMFA(w, r)
+	case "/auth/mfa/validate":
+		s.handleMFAValidate(w, r)
+	case "/auth/trust":
+		s.handleTrust(w, r)
+	case "/auth/token":
+		s.handleToken(w, r)
+	case "/auth/logout":
+		s.handleLogout(w, r)
+	case "/graphql":
+		s.handleGraphQL(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username != s.fixture.Username || password != s.fixture.Password {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", verisure.ErrorCodeUnauthorized, "Invalid username or password")
+		return
+	}
+
+	if s.fixture.MFACode != "" && !s.hasValidCookie(r, TrustCookieName) {
+		s.issueCookie(w, StepUpCookieName, 5*time.Minute)
+		writeJSON(w, http.StatusOK, map[string]string{"stepUpToken": "step-up"})
+		return
+	}
+
+	s.issueSession(w)
+	writeJSON(w, http.StatusOK, map[string]string{"accessToken": "access"})
+}
+
+func (s *Server) handleMFA(w http.ResponseWriter, r *http.Request) {
+	if !s.hasValidCookie(r, StepUpCookieName) {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", verisure.ErrorCodeUnauthorized, "No login in progress")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleMFAValidate(w http.ResponseWriter, r *http.Request) {
+	body := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !s.hasValidCookie(r, StepUpCookieName) || body["token"] != s.fixture.MFACode {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", verisure.ErrorCodeUnauthorized, "Invalid verification code")
+		return
+	}
+
+	s.issueSession(w)
+	writeJSON(w, http.StatusOK, map[string]string{"accessToken": "access"})
+}
+
+func (s *Server) handleTrust(w http.ResponseWriter, r *http.Request) {
+	if !s.hasValidCookie(r, AccessCookieName) {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", verisure.ErrorCodeUnauthorized, "Session expired")
+		return
+	}
+	s.issueCookie(w, TrustCookieName, 30*24*time.Hour)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if !s.hasValidCookie(r, RefreshCookieName) {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", verisure.ErrorCodeUnauthorized, "Refresh token expired")
+		return
+	}
+	s.issueCookie(w, AccessCookieName, s.AccessTTL)
+	writeJSON(w, http.StatusOK, map[string]string{"accessToken": "access"})
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	for _, name := range []string{AccessCookieName, RefreshCookieName} {
+		if cookie, err := r.Cookie(name); err == nil {
+			delete(s.tokens, cookie.Value)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	if len(s.failures) > 0 {
+		f := s.failures[0]
+		s.failures = s.failures[1:]
+		if f.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(f.retryAfter.Seconds())))
+		}
+		writeError(w, f.status, http.StatusText(f.status), verisure.ErrorCodeRateLimited, http.StatusText(f.status))
+		return
+	}
+
+	if s.switchCount > 0 {
+		s.switchCount--
+		writeError(w, http.StatusOK, "SERVICE_UNAVAILABLE", verisure.ErrorCodeServerSwitch, "Request another server")
+		return
+	}
+
+	if !s.hasValidCookie(r, AccessCookieName) {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", verisure.ErrorCodeUnauthorized, "Session expired")
+		return
+	}
+
+	q := struct {
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+		Query         string                 `json:"query"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		writeError(w, http.StatusBadRequest, "BAD_REQUEST", "SYS_00002", "Invalid request body")
+		return
+	}
+	s.operations = append(s.operations, q.OperationName)
+
+	if q.OperationName == "fetchAllInstallations" {
+		installations := []model.Installation{}
+		for _, installation := range s.fixture.Installations {
+			installations = append(installations, model.Installation{
+				Giid:          installation.Giid,
+				Alias:         installation.Alias,
+				CustomerType:  installation.CustomerType,
+				DealerID:      installation.DealerID,
+				PinCodeLength: installation.PinCodeLength,
+				Locale:        installation.Locale,
+				Address:       installation.Address,
+				Typename:      "Installation",
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": model.Data{Account: &model.Account{Installations: installations, Typename: "Account"}}})
+		return
+	}
+
+	giid, _ := q.Variables["giid"].(string)
+	installation := s.fixture.getInstallation(giid)
+	if installation == nil {
+		writeError(w, http.StatusOK, "NOT_FOUND", verisure.ErrorCodeInstallationNotFound, "Installation not found")
+		return
+	}
+
+	s.completeLocks(installation)
+
+	result := &model.Installation{Giid: installation.Giid, Typename: "Installation"}
+	switch q.OperationName {
+	case "GetState":
+		result.Climates = installation.Climates
+		result.DoorWindows = installation.DoorWindows
+		result.SmartLocks = smartLocks(installation)
+		result.SmartPlugs = installation.SmartPlugs
+		result.ArmState = installation.ArmState
+	case "Climate":
+		result.Climates = installation.Climates
+	case "DoorWindow":
+		result.DoorWindows = installation.DoorWindows
+	case "SmartLock":
+		result.SmartLocks = smartLocks(installation)
+	case "DoorLockConfiguration":
+		deviceLabel, _ := q.Variables["deviceLabel"].(string)
+		for _, lock := range installation.SmartLocks {
+			if lock.Device.DeviceLabel == deviceLabel && lock.Configuration != nil {
+				result.SmartLocks = append(result.SmartLocks, model.SmartLockDevice{Device: lock.Device, Configuration: lock.Configuration, Typename: lock.Typename})
+			}
+		}
+	case "SmartPlug":
+		result.SmartPlugs = installation.SmartPlugs
+	case "ArmState":
+		result.ArmState = installation.ArmState
+	case "userTrackings":
+		result.UserTrackings = installation.UserTrackings
+	case "DoorLock", "DoorUnlock", "DoorLockUpdateConfig", "armAway", "armHome", "disarm", "UpdateState":
+		s.handleMutation(w, installation, q.OperationName, q.Variables)
+		return
+	default:
+		writeError(w, http.StatusOK, "BAD_REQUEST", "SYS_00002", "Unknown operation "+q.OperationName)
+		return
+	}
+
+	selectDeviceFields(result, q.Query)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"data": model.Data{Installation: result}})
+}
+
+// selectDeviceFields leaves out the area and GUI label of devices when the query doesn't ask for them, like Verisure
+// does, so that a query missing them is noticed.
+func selectDeviceFields(result *model.Installation, query string) {
+	if area, gui := selectedDeviceFields(query, "climates"); !area || !gui {
+		climates := append([]model.ClimateDevice{}, result.Climates...)
+		for i := range climates {
+			stripDevice(&climates[i].Device, area, gui)
+		}
+		result.Climates = climates
+	}
+	if area, gui := selectedDeviceFields(query, "doorWindows"); !area || !gui {
+		doorWindows := append([]model.DoorWindowDevice{}, result.DoorWindows...)
+		for i := range doorWindows {
+			stripDevice(&doorWindows[i].Device, area, gui)
+		}
+		result.DoorWindows = doorWindows
+	}
+	if area, gui := selectedDeviceFields(query, "smartLocks"); !area || !gui {
+		smartLocks := append([]model.SmartLockDevice{}, result.SmartLocks...)
+		for i := range smartLocks {
+			stripDevice(&smartLocks[i].Device, area, gui)
+		}
+		result.SmartLocks = smartLocks
+	}
+	if area, gui := selectedDeviceFields(query, "smartplugs"); !area || !gui {
+		smartPlugs := append([]model.SmartPlugDevice{}, result.SmartPlugs...)
+		for i := range smartPlugs {
+			stripDevice(&smartPlugs[i].Device, area, gui)
+		}
+		result.SmartPlugs = smartPlugs
+	}
+}
+
+func stripDevice(device *model.Device, area bool, gui bool) {
+	if !area {
+		device.Area = ""
+	}
+	if !gui {
+		device.Gui = model.Gui{}
+	}
+}
+
+// selectedDeviceFields returns whether the query selects area and gui in the device of a list of devices.
+func selectedDeviceFields(query string, list string) (bool, bool) {
+	i := strings.Index(query, list+" ")
+	if i < 0 {
+		return false, false
+	}
+	rest := query[i:]
+	j := strings.Index(rest, "device {")
+	if j < 0 {
+		return false, false
+	}
+	rest = rest[j+len("device {"):]
+	depth := 1
+	for k, c := range rest {
+		if c == '{' {
+			depth++
+		} else if c == '}' {
+			if depth--; depth == 0 {
+				rest = rest[:k]
+				break
+			}
+		}
+	}
+
+	area, gui := false, false
+	for _, field := range strings.Fields(rest) {
+		switch field {
+		case "area":
+			area = true
+		case "gui":
+			gui = true
+		}
+	}
+	return area, gui
+}
+
+func (s *Server) handleMutation(w http.ResponseWriter, installation *model.Installation, operationName string, variables map[string]interface{}) {
+	code, _ := variables["code"].(string)
+	if input, ok := variables["input"].(map[string]interface{}); ok {
+		code, _ = input["code"].(string)
+	}
+	deviceLabel, _ := variables["deviceLabel"].(string)
+	now := time.Now().UTC()
+
+	switch operationName {
+	case "DoorLock", "DoorUnlock":
+		if code != s.fixture.Pin {
+			writeError(w, http.StatusOK, "BAD_REQUEST", verisure.ErrorCodeWrongPin, "Invalid code")
+			return
+		}
+		for i := range installation.SmartLocks {
+			lock := &installation.SmartLocks[i]
+			if lock.Device.DeviceLabel != deviceLabel {
+				continue
+			}
+			if errorCode := s.busyLocks[deviceLabel]; errorCode != "" {
+				delete(s.busyLocks, deviceLabel)
+				writeError(w, http.StatusOK, "CONFLICT", errorCode, "Lock is busy")
+				return
+			}
+			status := model.LockStatusLocked
+			if operationName == "DoorUnlock" {
+				status = model.LockStatusUnlocked
+			}
+			if s.jammedLocks[deviceLabel] {
+				delete(s.jammedLocks, deviceLabel)
+				status = model.LockStatusJammed
+			}
+			lock.LockMethod = "REMOTE"
+			lock.User = model.User{Name: s.fixture.Username, Typename: "User"}
+			from := now.Add(s.StatusDelay)
+			s.pending[deviceLabel] = pendingLock{status: status, from: from, until: from.Add(s.LockDelay)}
+			s.completeLocks(installation)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]bool{operationName: true}})
+			return
+		}
+	case "DoorLockUpdateConfig":
+		input, _ := variables["input"].(map[string]interface{})
+		for i := range installation.SmartLocks {
+			lock := &installation.SmartLocks[i]
+			if lock.Device.DeviceLabel != deviceLabel || lock.Configuration == nil {
+				continue
+			}
+			config := *lock.Configuration
+			if enabled, ok := input["autoLockEnabled"].(bool); ok {
+				config.AutoLockEnabled = &enabled
+			}
+			if volume, ok := input["volume"].(string); ok {
+				config.Volume = volume
+			}
+			if voiceLevel, ok := input["voiceLevel"].(string); ok {
+				config.VoiceLevel = voiceLevel
+			}
+			lock.Configuration = &config
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]bool{operationName: true}})
+			return
+		}
+	case "armAway", "armHome", "disarm":
+		if code != s.fixture.Pin {
+			writeError(w, http.StatusOK, "BAD_REQUEST", verisure.ErrorCodeWrongPin, "Invalid code")
+			return
+		}
+		statusType := map[string]string{"armAway": model.ArmStateArmedAway, "armHome": model.ArmStateArmedHome, "disarm": model.ArmStateDisarmed}[operationName]
+		installation.ArmState = &model.ArmState{StatusType: statusType, Date: now, Name: s.fixture.Username, ChangedVia: "REMOTE", Typename: "ArmState"}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]string{operationName: "transaction"}})
+		return
+	case "UpdateState":
+		// Verisure doesn't ask for a code to switch a plug, but a code that is sent has to be right.
+		if _, ok := variables["code"]; ok && code != s.fixture.Pin {
+			writeError(w, http.StatusOK, "BAD_REQUEST", verisure.ErrorCodeWrongPin, "Invalid code")
+			return
+		}
+		state, _ := variables["state"].(bool)
+		for i := range installation.SmartPlugs {
+			plug := &installation.SmartPlugs[i]
+			if plug.Device.DeviceLabel != deviceLabel {
+				continue
+			}
+			plug.CurrentState = "OFF"
+			if state {
+				plug.CurrentState = "ON"
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]bool{"SmartPlugSetState": true}})
+			return
+		}
+	}
+
+	writeError(w, http.StatusOK, "NOT_FOUND", "DEV_00001", "Device not found")
+}
+
+// smartLocks returns the smart locks without their configuration, which is only sent by DoorLockConfiguration.
+func smartLocks(installation *model.Installation) []model.SmartLockDevice {
+	locks := []model.SmartLockDevice{}
+	for _, lock := range installation.SmartLocks {
+		lock.Configuration = nil
+		locks = append(locks, lock)
+	}
+	return locks
+}
+
+// completeLocks moves locked or unlocked smart locks to pending once the status delay has passed, and to their final
+// state once the lock delay has passed too.
+func (s *Server) completeLocks(installation *model.Installation) {
+	now := time.Now().UTC()
+	for i := range installation.SmartLocks {
+		lock := &installation.SmartLocks[i]
+		p, ok := s.pending[lock.Device.DeviceLabel]
+		if !ok || now.Before(p.from) {
+			continue
+		}
+		if now.Before(p.until) {
+			if lock.LockStatus != model.LockStatusPending {
+				lock.LockStatus = model.LockStatusPending
+				lock.EventTime = p.from
+			}
+			continue
+		}
+		delete(s.pending, lock.Device.DeviceLabel)
+		lock.LockStatus = p.status
+		lock.EventTime = now
+	}
+}
+
+func (s *Server) issueSession(w http.ResponseWriter) {
+	s.issueCookie(w, AccessCookieName, s.AccessTTL)
+	s.issueCookie(w, RefreshCookieName, s.RefreshTTL)
+}
+
+func (s *Server) issueCookie(w http.ResponseWriter, name string, ttl time.Duration) {
+	value := newTokenValue()
+	expires := time.Now().Add(ttl)
+	s.tokens[value] = token{name: name, expires: expires}
+	http.SetCookie(w, &http.Cookie{Name: name, Value: value, Path: "/", Expires: expires, HttpOnly: true})
+}
+
+func (s *Server) hasValidCookie(r *http.Request, name string) bool {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return false
+	}
+	t, ok := s.tokens[cookie.Value]
+	return ok && t.name == name && time.Now().Before(t.expires)
+}
+
+func newTokenValue() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, errorGroup string, errorCode string, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"errors": []model.Errors{{
+			Message: message,
+			Data: model.ErrorData{
+				Status:       status,
+				LogTraceID:   newTokenValue(),
+				ErrorGroup:   errorGroup,
+				ErrorCode:    errorCode,
+				ErrorMessage: message,
+			},
+		}},
+	})
+}
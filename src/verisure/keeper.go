@@ -0,0 +1,244 @@
+package verisure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/futurehomeno/fimpgo/edgeapp"
+	log "github.com/sirupsen/logrus"
+	"github.com/thingsplex/verisure/model"
+)
+
+// SessionStatus describes the Verisure session as seen by the SessionKeeper.
+type SessionStatus struct {
+	Authenticated  bool      `json:"authenticated"`
+	AccessExpires  time.Time `json:"access_expires"`
+	RefreshExpires time.Time `json:"refresh_expires"`
+	LastRefresh    time.Time `json:"last_refresh"`
+	LastError      string    `json:"last_error"`
+	NextLogin      time.Time `json:"next_login,omitempty"`
+}
+
+// SessionKeeper refreshes the access cookie before it expires and warns through the app lifecycle
+// when the refresh cookie is about to expire, or has expired and a new login is needed.
+// If the credentials were remembered at login, it logs in again by itself when the session is lost.
+type SessionKeeper struct {
+	client          *Client
+	appLifecycle    *edgeapp.Lifecycle
+	refreshBefore   time.Duration
+	warnBefore      time.Duration
+	retryAfter      time.Duration
+	minLoginBackoff time.Duration
+	maxLoginBackoff time.Duration
+	now             func() time.Time
+
+	mu           sync.Mutex
+	status       SessionStatus
+	warned       bool
+	wake         chan struct{}
+	loginBackoff time.Duration
+	loginAt      time.Time
+	needsCode    bool
+}
+
+func NewSessionKeeper(client *Client, appLifecycle *edgeapp.Lifecycle) *SessionKeeper {
+	return &SessionKeeper{
+		client:          client,
+		appLifecycle:    appLifecycle,
+		refreshBefore:   2 * time.Minute,
+		warnBefore:      24 * time.Hour,
+		retryAfter:      time.Minute,
+		minLoginBackoff: 5 * time.Minute,
+		maxLoginBackoff: 6 * time.Hour,
+		now:             time.Now,
+		wake:            make(chan struct{}, 1),
+	}
+}
+
+// Start runs the keeper until ctx is cancelled.
+func (sk *SessionKeeper) Start(ctx context.Context) {
+	go func() {
+		for {
+			next := sk.check(ctx)
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-timer.C:
+			case <-sk.wake:
+				timer.Stop()
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Wake makes the keeper look at the session again right away, e.g. after a login.
+func (sk *SessionKeeper) Wake() {
+	select {
+	case sk.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sk *SessionKeeper) Status() SessionStatus {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	return sk.status
+}
+
+// check refreshes the session if needed and returns when it should be checked next.
+func (sk *SessionKeeper) check(ctx context.Context) time.Time {
+	now := sk.now()
+	access := sk.client.states.GetCookieByName("vs-access")
+	refresh := sk.client.states.GetCookieByName("vs-refresh")
+
+	// The status is only written by the keeper goroutine; the lock keeps Status readers consistent.
+	status := sk.Status()
+	defer func() {
+		sk.mu.Lock()
+		sk.status = status
+		sk.mu.Unlock()
+	}()
+
+	if refresh == nil {
+		if next, ok := sk.relogin(ctx, &status, now); ok {
+			return next
+		}
+		status = SessionStatus{}
+		sk.warned = false
+		return now.Add(time.Hour)
+	}
+
+	status.RefreshExpires = refresh.Expires
+	if access != nil {
+		status.AccessExpires = access.Expires
+	}
+
+	// An imported refresh cookie has no known expiry and is used until Verisure rejects it.
+	knownExpiry := !refresh.Expires.IsZero()
+	if knownExpiry && !now.Before(refresh.Expires) {
+		if next, ok := sk.relogin(ctx, &status, now); ok {
+			return next
+		}
+		if status.Authenticated || status.LastError == "" {
+			log.Warn("Verisure refresh cookie expired")
+			sk.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+			sk.appLifecycle.SetConnectionState(edgeapp.ConnStateDisconnected)
+			sk.appLifecycle.SetLastError("Verisure session expired, log in again")
+		}
+		status.Authenticated = false
+		status.LastError = "refresh cookie expired"
+		return now.Add(time.Hour)
+	}
+
+	if access == nil || now.Add(sk.refreshBefore).After(access.Expires) {
+		log.Debug("Refreshing Verisure access cookie")
+		if err := sk.client.RefreshTokenContext(ctx); err != nil {
+			log.Error("Failed to refresh Verisure session: ", err)
+			if errors.Is(err, ErrSessionExpired) {
+				if next, ok := sk.relogin(ctx, &status, now); ok {
+					return next
+				}
+			}
+			status.LastError = err.Error()
+			sk.appLifecycle.SetLastError("Failed to refresh Verisure session")
+			return now.Add(sk.retryAfter)
+		}
+		status.LastRefresh = now
+		status.LastError = ""
+		if access = sk.client.states.GetCookieByName("vs-access"); access != nil {
+			status.AccessExpires = access.Expires
+		}
+	}
+	status.Authenticated = true
+	status.NextLogin = time.Time{}
+	sk.loginBackoff = 0
+	sk.loginAt = time.Time{}
+	sk.needsCode = false
+
+	if knownExpiry && now.Add(sk.warnBefore).After(refresh.Expires) {
+		if !sk.warned {
+			sk.warned = true
+			log.Warn("Verisure session expires ", refresh.Expires.Format(time.RFC3339))
+			sk.appLifecycle.SetLastError(fmt.Sprintf("Verisure session expires %s, log in again to renew it", refresh.Expires.Format(time.RFC3339)))
+			sk.appLifecycle.SetAuthState(model.AuthStateExpiring)
+		}
+	} else if sk.warned {
+		sk.warned = false
+		sk.appLifecycle.SetLastError("")
+		sk.appLifecycle.SetAuthState(edgeapp.AuthStateAuthenticated)
+	}
+
+	next := refresh.Expires
+	if warnAt := refresh.Expires.Add(-sk.warnBefore); !sk.warned && warnAt.Before(next) {
+		next = warnAt
+	}
+	if refreshAt := status.AccessExpires.Add(-sk.refreshBefore); refreshAt.Before(next) {
+		next = refreshAt
+	}
+	if next.Before(now.Add(sk.retryAfter)) {
+		next = now.Add(sk.retryAfter)
+	}
+	return next
+}
+
+// relogin logs in with the remembered credentials after the session was lost, and returns when to check again.
+// Failed logins are retried with a growing backoff so that Verisure doesn't lock the account. It returns false
+// if there are no remembered credentials, or if Verisure asked for a verification code and the user has to log in.
+func (sk *SessionKeeper) relogin(ctx context.Context, status *SessionStatus, now time.Time) (time.Time, bool) {
+	sk.client.states.Lock()
+	username := sk.client.states.Username
+	password := sk.client.states.Password
+	sk.client.states.Unlock()
+	if username == "" || password == "" || sk.needsCode {
+		return time.Time{}, false
+	}
+	status.Authenticated = false
+	if now.Before(sk.loginAt) {
+		return sk.loginAt, true
+	}
+
+	log.Info("Verisure session lost, logging in again")
+	sk.appLifecycle.SetAuthState(edgeapp.AuthStateInProgress)
+	// Login reuses a session that still has a valid access cookie, so it has to be cleared for a new refresh cookie.
+	if err := sk.client.states.Session.Clear(); err != nil {
+		log.Error(err)
+	}
+	err := sk.client.LoginContext(ctx, username, password)
+	switch {
+	case err == nil:
+		log.Info("Logged in to Verisure again")
+		sk.appLifecycle.SetAuthState(edgeapp.AuthStateAuthenticated)
+		sk.appLifecycle.SetLastError("")
+		status.LastError = ""
+		// Check again right away to pick up the new session.
+		return now, true
+	case errors.Is(err, ErrMFARequired):
+		log.Warn("Verisure needs a verification code to log in again")
+		sk.needsCode = true
+		sk.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+		sk.appLifecycle.SetConnectionState(edgeapp.ConnStateDisconnected)
+		sk.appLifecycle.SetLastError("Verisure needs a verification code, log in again")
+		status.LastError = err.Error()
+		status.NextLogin = time.Time{}
+		return now.Add(time.Hour), true
+	}
+
+	if sk.loginBackoff == 0 {
+		sk.loginBackoff = sk.minLoginBackoff
+	} else if sk.loginBackoff *= 2; sk.loginBackoff > sk.maxLoginBackoff {
+		sk.loginBackoff = sk.maxLoginBackoff
+	}
+	sk.loginAt = now.Add(sk.loginBackoff)
+	log.Error("Failed to log in to Verisure again: ", err)
+	sk.appLifecycle.SetAuthState(edgeapp.AuthStateNotAuthenticated)
+	sk.appLifecycle.SetConnectionState(edgeapp.ConnStateDisconnected)
+	sk.appLifecycle.SetLastError(fmt.Sprintf("Failed to log in to Verisure again, next try %s", sk.loginAt.Format(time.RFC3339)))
+	status.LastError = err.Error()
+	status.NextLogin = sk.loginAt
+	return sk.loginAt, true
+}
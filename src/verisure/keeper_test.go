@@ -0,0 +1,125 @@
+package verisure_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/futurehomeno/fimpgo/edgeapp"
+	"github.com/thingsplex/verisure/model"
+	"github.com/thingsplex/verisure/verisure"
+	"github.com/thingsplex/verisure/verisure/fake"
+)
+
+// waitForAuthState waits for the keeper to set the auth state of the app.
+func waitForAuthState(t *testing.T, events edgeapp.SystemEventChannel, want edgeapp.State) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == edgeapp.SystemEventTypeAuthState && event.State == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("auth state never became %s", want)
+		}
+	}
+}
+
+func TestKeeperWarnsBeforeSessionExpires(t *testing.T) {
+	states := newTestStates(t)
+	client, err := verisure.NewClient(states, verisure.WithBaseURLs("https://automation01.verisure.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://automation01.verisure.com/auth/login")
+	now := time.Now()
+	states.Session.SetCookies(u, []*http.Cookie{
+		{Name: "vs-access", Value: "access", Path: "/", Expires: now.Add(10 * time.Minute)},
+		{Name: "vs-refresh", Value: "refresh", Path: "/", Expires: now.Add(time.Hour)},
+	})
+
+	appLifecycle := edgeapp.NewAppLifecycle()
+	events := appLifecycle.Subscribe("test", 10)
+	keeper := verisure.NewSessionKeeper(client, appLifecycle)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keeper.Start(ctx)
+
+	waitForAuthState(t, events, model.AuthStateExpiring)
+	if appLifecycle.LastError() == "" {
+		t.Error("no warning in the last error")
+	}
+
+	// A new login renews the session.
+	states.Lock()
+	states.Session.SetCookies(u, []*http.Cookie{{Name: "vs-refresh", Value: "renewed", Path: "/", Expires: now.Add(30 * 24 * time.Hour)}})
+	states.Unlock()
+	keeper.Wake()
+	waitForAuthState(t, events, edgeapp.AuthStateAuthenticated)
+}
+
+func TestKeeperLogsInAgainWithBackoff(t *testing.T) {
+	fixture, err := fake.LoadFixture("fake/testdata/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(fake.NewServer(fixture))
+	defer httpServer.Close()
+	states := newTestStates(t)
+	states.Username = testUsername
+	states.Password = "wrong"
+	client, err := verisure.NewClient(states, verisure.WithBaseURLs(httpServer.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appLifecycle := edgeapp.NewAppLifecycle()
+	keeper := verisure.NewSessionKeeper(client, appLifecycle)
+	now := time.Now()
+	keeper.SetClock(func() time.Time { return now })
+	ctx := context.Background()
+
+	// Failed logins are retried after 5 minutes, doubling up to 6 hours.
+	var next time.Time
+	for _, backoff := range []time.Duration{5, 10, 20, 40, 80, 160, 320, 360, 360} {
+		if next = keeper.Check(ctx); !next.Equal(now.Add(backoff * time.Minute)) {
+			t.Fatalf("next login in %s, want %s", next.Sub(now), backoff*time.Minute)
+		}
+		if status := keeper.Status(); status.Authenticated || !status.NextLogin.Equal(next) {
+			t.Fatalf("got status %+v after a failed login", status)
+		}
+		// Nothing is tried before the backoff is over.
+		if again := keeper.Check(ctx); !again.Equal(next) {
+			t.Fatalf("checked again at %s before the next login at %s", again, next)
+		}
+		now = next
+	}
+
+	states.Lock()
+	states.Password = testPassword
+	states.Unlock()
+	if next = keeper.Check(ctx); !next.Equal(now) {
+		t.Errorf("check %s after logging in again, want right away", next.Sub(now))
+	}
+	// The cookies of the new session expire in real time.
+	now = time.Now()
+	keeper.Check(ctx)
+	if status := keeper.Status(); !status.Authenticated || !status.NextLogin.IsZero() {
+		t.Errorf("got status %+v after logging in again", status)
+	}
+
+	// A new failure starts the backoff over.
+	states.Lock()
+	states.Password = "wrong"
+	states.Unlock()
+	if err := states.Session.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if next = keeper.Check(ctx); !next.Equal(now.Add(5 * time.Minute)) {
+		t.Errorf("next login in %s after a new failure, want 5m", next.Sub(now))
+	}
+}
@@ -0,0 +1,58 @@
+package verisure
+
+import (
+	"net/http"
+	"time"
+)
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for all requests. Defaults to http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithBaseURLs sets the Verisure API servers, in the order they are tried.
+func WithBaseURLs(baseURLs ...string) Option {
+	return func(c *Client) {
+		c.baseURLs = append([]string{}, baseURLs...)
+	}
+}
+
+// WithApplicationID sets the APPLICATION_ID header sent with every request.
+func WithApplicationID(applicationID string) Option {
+	return func(c *Client) {
+		c.applicationID = applicationID
+	}
+}
+
+// WithRequestTimeout limits how long a single request to Verisure may take. Zero means no limit.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.requestTimeout = timeout
+	}
+}
+
+// WithRetryPolicy sets how many times a request is attempted and the bounds of the backoff between attempts.
+func WithRetryPolicy(maxAttempts int, minBackoff time.Duration, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.retry = retryPolicy{maxAttempts: maxAttempts, minBackoff: minBackoff, maxBackoff: maxBackoff}
+	}
+}
+
+// WithRequestBudget limits each installation to the given number of requests per period. Zero disables the limit.
+func WithRequestBudget(requests int, period time.Duration) Option {
+	return func(c *Client) {
+		c.budget = newRequestBudget(requests, period)
+	}
+}
+
+// WithLockPollInterval sets how often the lock is polled while waiting for a lock or unlock to complete.
+func WithLockPollInterval(interval time.Duration) Option {
+	return func(c *Client) {
+		c.lockPoll = interval
+	}
+}
@@ -0,0 +1,144 @@
+package verisure
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrRequestBudgetExceeded is returned instead of sending a request when the installation has used up its request budget,
+// or while Verisure has asked us to back off. It matches ErrRateLimited.
+var ErrRequestBudgetExceeded error = budgetError{}
+
+type budgetError struct{}
+
+func (budgetError) Error() string {
+	return "request budget exceeded"
+}
+
+func (budgetError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// HTTPError is returned when Verisure answers with a status code outside 2xx.
+type HTTPError struct {
+	StatusCode int
+	URL        string
+	Body       []byte
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("got %d from %s", e.StatusCode, e.URL)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *HTTPError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+type retryPolicy struct {
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+}
+
+// backoff returns the delay before the given retry, doubling per attempt with jitter.
+func (rp retryPolicy) backoff(attempt int) time.Duration {
+	d := rp.minBackoff << uint(attempt)
+	if d <= 0 || d > rp.maxBackoff {
+		d = rp.maxBackoff
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// isDialError reports whether the request failed while connecting, so it was never sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// retryAfter parses the Retry-After header, given either in seconds or as a date.
+func retryAfter(res *http.Response) time.Duration {
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+type budget struct {
+	tokens       float64
+	last         time.Time
+	blockedUntil time.Time
+}
+
+// requestBudget is a token bucket per installation, refilled at requests per period.
+type requestBudget struct {
+	mu       sync.Mutex
+	requests int
+	period   time.Duration
+	budgets  map[string]*budget
+}
+
+func newRequestBudget(requests int, period time.Duration) *requestBudget {
+	return &requestBudget{requests: requests, period: period, budgets: map[string]*budget{}}
+}
+
+func (rb *requestBudget) get(giid string, now time.Time) *budget {
+	b, ok := rb.budgets[giid]
+	if !ok {
+		b = &budget{tokens: float64(rb.requests), last: now}
+		rb.budgets[giid] = b
+	}
+	return b
+}
+
+// take uses one request from the installation's budget.
+func (rb *requestBudget) take(giid string) error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	now := time.Now()
+	b := rb.get(giid, now)
+	if now.Before(b.blockedUntil) {
+		return ErrRequestBudgetExceeded
+	}
+	if rb.requests <= 0 || rb.period <= 0 {
+		return nil
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() / rb.period.Seconds() * float64(rb.requests)
+	if b.tokens > float64(rb.requests) {
+		b.tokens = float64(rb.requests)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return ErrRequestBudgetExceeded
+	}
+	b.tokens--
+	return nil
+}
+
+// block stops requests for the installation until the given time.
+func (rb *requestBudget) block(giid string, until time.Time) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	b := rb.get(giid, time.Now())
+	if until.After(b.blockedUntil) {
+		b.blockedUntil = until
+	}
+}
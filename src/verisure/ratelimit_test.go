@@ -0,0 +1,139 @@
+package verisure_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/thingsplex/verisure/model"
+	"github.com/thingsplex/verisure/verisure"
+	"github.com/thingsplex/verisure/verisure/fake"
+)
+
+var fastRetries = verisure.WithRetryPolicy(4, time.Millisecond, 10*time.Millisecond)
+
+func TestReadsAreRetried(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		status   int
+		wantErr  bool
+	}{
+		{"503 once", 1, http.StatusServiceUnavailable, false},
+		{"503 until out of attempts", 4, http.StatusServiceUnavailable, true},
+		{"429 without Retry-After", 2, http.StatusTooManyRequests, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newTestClient(t, fastRetries)
+			if err := client.Login(testUsername, testPassword); err != nil {
+				t.Fatal(err)
+			}
+
+			server.FailNext(tt.failures, tt.status, 0)
+			_, err := client.FetchInstallationState()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMutationsAreNotRetried(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			client, server := newTestClient(t, fastRetries)
+			if err := client.Login(testUsername, testPassword); err != nil {
+				t.Fatal(err)
+			}
+
+			server.FailNext(1, status, 0)
+			if err := client.ArmAway(testPin); err == nil {
+				t.Fatal("arming succeeded after a failed request")
+			}
+			if state := server.Installation(testGIID).ArmState.StatusType; state != model.ArmStateDisarmed {
+				t.Errorf("arm state is %s, the mutation was sent again", state)
+			}
+		})
+	}
+}
+
+func TestMutationRetriedAfterDialError(t *testing.T) {
+	fixture, err := fake.LoadFixture("fake/testdata/fixture.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fake.NewServer(fixture)
+	up := httptest.NewServer(server)
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	states := newTestStates(t)
+	loggedIn, err := verisure.NewClient(states, verisure.WithBaseURLs(up.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loggedIn.Login(testUsername, testPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := verisure.NewClient(states, verisure.WithBaseURLs(down.URL, up.URL), fastRetries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetGIID(testGIID)
+	if err := client.ArmAway(testPin); err != nil {
+		t.Fatal(err)
+	}
+	if state := server.Installation(testGIID).ArmState.StatusType; state != model.ArmStateArmedAway {
+		t.Errorf("arm state is %s, want %s", state, model.ArmStateArmedAway)
+	}
+}
+
+func TestRateLimitWithLongRetryAfterBlocksInstallation(t *testing.T) {
+	client, server := newTestClient(t, fastRetries)
+	if err := client.Login(testUsername, testPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	server.FailNext(1, http.StatusTooManyRequests, time.Hour)
+	if _, err := client.FetchInstallationState(); !errors.Is(err, verisure.ErrRateLimited) {
+		t.Fatalf("got %v, want ErrRateLimited", err)
+	}
+	operations := len(server.Operations())
+	if _, err := client.FetchInstallationState(); !errors.Is(err, verisure.ErrRequestBudgetExceeded) {
+		t.Fatalf("got %v, want ErrRequestBudgetExceeded while blocked", err)
+	}
+	if len(server.Operations()) != operations {
+		t.Error("a request was sent while the installation was blocked")
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	client, server := newTestClient(t, verisure.WithRequestBudget(2, time.Hour))
+	if err := client.Login(testUsername, testPassword); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.FetchInstallationState(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := client.FetchInstallationState()
+	if !errors.Is(err, verisure.ErrRequestBudgetExceeded) || !errors.Is(err, verisure.ErrRateLimited) {
+		t.Fatalf("got %v, want ErrRequestBudgetExceeded", err)
+	}
+	if len(server.Operations()) != 2 {
+		t.Errorf("server got %d requests, want 2", len(server.Operations()))
+	}
+
+	// Each installation has its own budget.
+	client.SetGIID("other")
+	if _, err := client.FetchInstallationState(); errors.Is(err, verisure.ErrRequestBudgetExceeded) {
+		t.Error("another installation shares the budget")
+	}
+}
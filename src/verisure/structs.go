@@ -12,3 +12,9 @@ type GraphQLResponse struct {
 	Errors []*model.Errors `json:"errors"`
 	Data   *model.Data     `json:"data"`
 }
+
+type LoginResponse struct {
+	AccessToken  string `json:"accessToken"`
+	StepUpToken  string `json:"stepUpToken"`
+	RefreshToken string `json:"refreshToken"`
+}